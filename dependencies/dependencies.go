@@ -9,3 +9,21 @@ var K3SDependency = ertia.Dependency{
 	Status:  ertia.DependencyStatusNew,
 	Retries: 0,
 }
+
+// HelmChartDependency is installed on the server that installs the named
+// chart into the cluster.
+func HelmChartDependency(chart string) ertia.Dependency {
+	return ertia.Dependency{
+		Name:   "HELM:" + chart,
+		Status: ertia.DependencyStatusNew,
+	}
+}
+
+// SecretDependency is installed on the server that creates the named secret
+// in the cluster.
+func SecretDependency(name string) ertia.Dependency {
+	return ertia.Dependency{
+		Name:   "SECRET:" + name,
+		Status: ertia.DependencyStatusNew,
+	}
+}
@@ -0,0 +1,398 @@
+package dependencies
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	ertia "github.com/ertia-io/config/pkg/entities"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	ErrorInvalidGraph = errors.New("Dependencies.InvalidGraph")
+	ErrorBlocked      = errors.New("Dependencies.Blocked")
+	ErrorFailing      = errors.New("Dependencies.Failing")
+
+	// ErrorNotReady is returned by installers when the node can not be
+	// worked on yet, e.g. SSH is not up. The install is tried again with
+	// backoff until the retries are used up.
+	ErrorNotReady = errors.New("Dependencies.NotReady")
+)
+
+// Scope tells where a requirement has to be ready.
+type Scope int
+
+const (
+	// SameNode requires the dependency to be ready on the node itself.
+	SameNode Scope = iota
+
+	// AnyNode requires the dependency to be ready on at least one node.
+	AnyNode
+)
+
+// Requirement names a definition that has to be ready first.
+type Requirement struct {
+	ID    string
+	Scope Scope
+}
+
+// Installer installs a dependency on the node.
+type Installer func(ctx context.Context, cfg *ertia.Project, node *ertia.Node) (*ertia.Project, error)
+
+// ReadinessCheck confirms an installed dependency works on the node.
+type ReadinessCheck func(ctx context.Context, cfg *ertia.Project, node *ertia.Node) error
+
+// Definition describes how a dependency is installed on the nodes it
+// applies to.
+type Definition struct {
+	// ID names the definition in requirements, e.g. k3s-agent.
+	ID string
+
+	// Dependency is the name of the node dependency it installs, several
+	// definitions may install the same dependency on different nodes.
+	Dependency string
+
+	// Applies selects the nodes the definition installs on, all when nil.
+	Applies func(node *ertia.Node) bool
+
+	Requires []Requirement
+
+	Install Installer
+
+	// Serial installs the definition on one node at a time, before the
+	// nodes installed in parallel, e.g. servers joining etcd.
+	Serial bool
+
+	// Outdated tells whether a ready dependency has to be installed again,
+	// e.g. because its configuration changed. A dependency still outdated
+	// after as many installs as the retry limit is marked failing.
+	// Optional.
+	Outdated func(cfg *ertia.Project, node *ertia.Node) bool
+
+	// Ready is checked after Install, the dependency is marked failing
+	// when it does not pass. Optional.
+	Ready ReadinessCheck
+}
+
+func (d *Definition) applies(node *ertia.Node) bool {
+	return d.Applies == nil || d.Applies(node)
+}
+
+// readyOn tells whether the definition is installed and ready on the node.
+func (d *Definition) readyOn(node *ertia.Node) bool {
+	return d.applies(node) && node.Fulfils(d.Dependency)
+}
+
+// outdated tells whether the dependency is ready on the node but has to be
+// installed again.
+func (d *Definition) outdated(cfg *ertia.Project, node *ertia.Node) bool {
+	return d.Outdated != nil && d.readyOn(node) && d.Outdated(cfg, node)
+}
+
+// Graph runs definitions in dependency order across the nodes of a
+// project.
+type Graph struct {
+	// Retry bounds reinstalling dependencies that are not ready,
+	// DefaultRetryPolicy unless changed.
+	Retry RetryPolicy
+
+	// Concurrency is the number of nodes installed at once,
+	// DefaultConcurrency unless changed.
+	Concurrency int
+
+	defs []Definition
+	byID map[string]int
+}
+
+// NewGraph validates that every requirement is defined and that there are
+// no cycles.
+func NewGraph(defs ...Definition) (*Graph, error) {
+	g := &Graph{Retry: DefaultRetryPolicy, Concurrency: DefaultConcurrency, defs: defs, byID: map[string]int{}}
+
+	for i, d := range defs {
+		if d.ID == "" || d.Dependency == "" || d.Install == nil {
+			return nil, fmt.Errorf("%w: definition %d needs an ID, dependency and installer", ErrorInvalidGraph, i)
+		}
+		if _, ok := g.byID[d.ID]; ok {
+			return nil, fmt.Errorf("%w: %s defined twice", ErrorInvalidGraph, d.ID)
+		}
+		g.byID[d.ID] = i
+	}
+
+	for _, d := range defs {
+		for _, r := range d.Requires {
+			if _, ok := g.byID[r.ID]; !ok {
+				return nil, fmt.Errorf("%w: %s requires unknown %s", ErrorInvalidGraph, d.ID, r.ID)
+			}
+		}
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make([]int, len(defs))
+	var visit func(i int, path []string) error
+	visit = func(i int, path []string) error {
+		path = append(path, defs[i].ID)
+		switch state[i] {
+		case visiting:
+			return fmt.Errorf("%w: cycle %s", ErrorInvalidGraph, strings.Join(path, " -> "))
+		case visited:
+			return nil
+		}
+		state[i] = visiting
+		for _, r := range defs[i].Requires {
+			err := visit(g.byID[r.ID], path)
+			if err != nil {
+				return err
+			}
+		}
+		state[i] = visited
+		return nil
+	}
+	for i := range defs {
+		err := visit(i, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return g, nil
+}
+
+// task is a definition to run on a node.
+type task struct {
+	nodeID string
+	def    *Definition
+}
+
+// pending lists what the nodes still require or have outdated, in node
+// order.
+func (g *Graph) pending(cfg *ertia.Project) []task {
+	var tasks []task
+	for i := range cfg.Nodes {
+		node := &cfg.Nodes[i]
+		for _, dep := range node.Dependencies {
+			for di := range g.defs {
+				d := &g.defs[di]
+				if d.Dependency != dep.Name || !d.applies(node) {
+					continue
+				}
+				if node.Requires(dep.Name) || d.outdated(cfg, node) {
+					tasks = append(tasks, task{nodeID: node.ID, def: d})
+				}
+				break
+			}
+		}
+	}
+	return tasks
+}
+
+// unmet returns the requirements of t that are not ready yet.
+func (g *Graph) unmet(cfg *ertia.Project, t task) []string {
+	node := cfg.FindNodeByID(t.nodeID)
+
+	var unmet []string
+	for _, r := range t.def.Requires {
+		req := &g.defs[g.byID[r.ID]]
+
+		met := false
+		switch r.Scope {
+		case SameNode:
+			met = req.readyOn(node)
+		case AnyNode:
+			for i := range cfg.Nodes {
+				if req.readyOn(&cfg.Nodes[i]) {
+					met = true
+					break
+				}
+			}
+		}
+		if !met {
+			unmet = append(unmet, r.ID)
+		}
+	}
+	return unmet
+}
+
+// Sync installs what the nodes require until nothing is left, serial
+// definitions one node at a time and the others on up to Concurrency nodes
+// at once. A dependency whose requirements can not be met any more is marked
+// waiting and Sync returns ErrorBlocked. A dependency that fails, is still
+// not ready after its retries or stays outdated, is marked failing and the
+// other nodes carry on; Sync returns the failures as Errors.
+func (g *Graph) Sync(ctx context.Context, cfg *ertia.Project) (*ertia.Project, error) {
+	var errs Errors
+
+	// Installs of outdated dependencies, which do not count as retries
+	// since every one of them succeeded.
+	reinstalls := map[task]int32{}
+
+	for {
+		var tasks []task
+		for _, t := range g.pending(cfg) {
+			if cfg.FindNodeByID(t.nodeID).Requires(t.def.Dependency) {
+				tasks = append(tasks, t)
+				continue
+			}
+
+			reinstalls[t]++
+			if reinstalls[t] <= g.Retry.MaxRetries {
+				tasks = append(tasks, t)
+				continue
+			}
+
+			var err error
+			cfg, err = g.stillOutdated(ctx, cfg, t, reinstalls[t]-1)
+			errs = append(errs, err)
+		}
+
+		if len(tasks) == 0 {
+			if len(errs) == 0 {
+				log.Ctx(ctx).Debug().Msg("All dependencies handled")
+			}
+			return cfg, errs.err()
+		}
+
+		var serial, parallel, blocked []task
+		for _, t := range tasks {
+			switch {
+			case len(g.unmet(cfg, t)) > 0:
+				blocked = append(blocked, t)
+			case t.def.Serial:
+				serial = append(serial, t)
+			default:
+				parallel = append(parallel, t)
+			}
+		}
+
+		if len(serial) == 0 && len(parallel) == 0 {
+			cfg, err := g.block(ctx, cfg, blocked)
+			return cfg, append(errs, err).err()
+		}
+
+		r := &round{g: g, cfg: cfg}
+		err := r.serial(ctx, serial)
+		if err == nil {
+			err = r.parallel(ctx, parallel)
+		}
+		cfg = r.cfg
+		errs = append(errs, r.errs...)
+		if err != nil {
+			return cfg, err
+		}
+
+		// The backoff follows the task with the fewest attempts, so a
+		// node that just came up is not held back by one that never does.
+		if r.attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return cfg, ctx.Err()
+			case <-time.After(g.Retry.backoff(r.attempt)):
+			}
+		}
+	}
+}
+
+// run installs one definition on one node and checks that it is ready.
+func (g *Graph) run(ctx context.Context, cfg *ertia.Project, t task) (*ertia.Project, error) {
+	node := cfg.FindNodeByID(t.nodeID)
+	log.Ctx(ctx).Info().Str("node", node.Name).Str("dependency", t.def.ID).Msg("Installing dependency")
+
+	cfg, err := t.def.Install(ctx, cfg, node)
+	if err != nil {
+		return cfg, err
+	}
+
+	node = cfg.FindNodeByID(t.nodeID)
+	status := ertia.DependencyStatusReady
+	if t.def.Ready != nil {
+		err = t.def.Ready(ctx, cfg, node)
+		if err != nil {
+			status = ertia.DependencyStatusFailing
+			node.Error = err.Error()
+		}
+	}
+
+	setStatus(node, t.def.Dependency, status)
+	if status == ertia.DependencyStatusReady {
+		dependency(node, t.def.Dependency).Retries = 0
+	}
+	return cfg.UpdateNode(node), err
+}
+
+// retry counts a failed attempt on the dependency and returns the attempts
+// so far. Once they reach the limit the dependency is marked failing with
+// the last error, otherwise it is marked retrying.
+func (g *Graph) retry(ctx context.Context, cfg *ertia.Project, t task, err error) (*ertia.Project, int32) {
+	node := cfg.FindNodeByID(t.nodeID)
+	dep := dependency(node, t.def.Dependency)
+	dep.Retries++
+
+	logger := log.Ctx(ctx)
+	if dep.Retries >= g.Retry.MaxRetries {
+		dep.Status = ertia.DependencyStatusFailing
+		node.Error = err.Error()
+		logger.Error().Err(err).Str("node", node.Name).Str("dependency", t.def.ID).Int32("attempts", dep.Retries).Msg("Dependency failed")
+	} else {
+		dep.Status = ertia.DependencyStatusRetrying
+		logger.Warn().Err(err).Str("node", node.Name).Str("dependency", t.def.ID).Int32("attempt", dep.Retries).Msg("Dependency not ready, retrying")
+	}
+
+	return cfg.UpdateNode(node), dep.Retries
+}
+
+// stillOutdated marks a dependency failing that is outdated again after
+// every reinstall the retry limit allows.
+func (g *Graph) stillOutdated(ctx context.Context, cfg *ertia.Project, t task, installs int32) (*ertia.Project, error) {
+	node := cfg.FindNodeByID(t.nodeID)
+	err := fmt.Errorf("still outdated after %d installs", installs)
+
+	setStatus(node, t.def.Dependency, ertia.DependencyStatusFailing)
+	node.Error = err.Error()
+	log.Ctx(ctx).Error().Err(err).Str("node", node.Name).Str("dependency", t.def.ID).Msg("Dependency failed")
+
+	return cfg.UpdateNode(node), &TaskError{Node: node.Name, Definition: t.def.ID, Err: err}
+}
+
+// block marks tasks whose requirements will not be met in this sync as
+// waiting, so they are picked up again later.
+func (g *Graph) block(ctx context.Context, cfg *ertia.Project, blocked []task) (*ertia.Project, error) {
+	reasons := make([]string, 0, len(blocked))
+	for _, t := range blocked {
+		node := cfg.FindNodeByID(t.nodeID)
+		unmet := g.unmet(cfg, t)
+
+		log.Ctx(ctx).Warn().Str("node", node.Name).Str("dependency", t.def.ID).Strs("unmet", unmet).Msg("Dependency blocked")
+		reasons = append(reasons, fmt.Sprintf("%s on %s needs %s", t.def.ID, node.Name, strings.Join(unmet, ", ")))
+
+		setStatus(node, t.def.Dependency, ertia.DependencyStatusWaiting)
+		cfg = cfg.UpdateNode(node)
+	}
+
+	return cfg, fmt.Errorf("%w: %s", ErrorBlocked, strings.Join(reasons, "; "))
+}
+
+// dependency returns the named dependency of the node, which pending only
+// hands out tasks for when it exists.
+func dependency(node *ertia.Node, name string) *ertia.Dependency {
+	for i := range node.Dependencies {
+		if node.Dependencies[i].Name == name {
+			return &node.Dependencies[i]
+		}
+	}
+	return nil
+}
+
+func setStatus(node *ertia.Node, dependency, status string) {
+	for i := range node.Dependencies {
+		if node.Dependencies[i].Name == dependency {
+			node.Dependencies[i].Status = status
+		}
+	}
+}
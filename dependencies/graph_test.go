@@ -0,0 +1,213 @@
+package dependencies
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+
+	ertia "github.com/ertia-io/config/pkg/entities"
+)
+
+var errBroken = errors.New("broken")
+
+// fakeInstaller records the nodes it installs on and fails with the errors
+// queued for each node, in order. It succeeds once the queue is empty.
+type fakeInstaller struct {
+	mu       sync.Mutex
+	installs map[string]int
+	errs     map[string][]error
+}
+
+func newFakeInstaller() *fakeInstaller {
+	return &fakeInstaller{installs: map[string]int{}, errs: map[string][]error{}}
+}
+
+func (f *fakeInstaller) Install(ctx context.Context, cfg *ertia.Project, node *ertia.Node) (*ertia.Project, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.installs[node.ID]++
+	if errs := f.errs[node.ID]; len(errs) > 0 {
+		f.errs[node.ID] = errs[1:]
+		return cfg, errs[0]
+	}
+	return cfg, nil
+}
+
+// project has a node per ID, each requiring the named dependencies.
+func project(ids []string, deps ...string) *ertia.Project {
+	cfg := &ertia.Project{}
+	for _, id := range ids {
+		node := ertia.Node{ID: id, Name: id}
+		for _, dep := range deps {
+			node.Dependencies = append(node.Dependencies, ertia.Dependency{Name: dep, Status: ertia.DependencyStatusNew})
+		}
+		cfg.Nodes = append(cfg.Nodes, node)
+	}
+	return cfg
+}
+
+func status(cfg *ertia.Project, nodeID, dep string) string {
+	return dependency(cfg.FindNodeByID(nodeID), dep).Status
+}
+
+func TestNewGraph(t *testing.T) {
+	install := newFakeInstaller().Install
+
+	cases := []struct {
+		name string
+		defs []Definition
+
+		// invalid is expected in the ErrorInvalidGraph error, none when
+		// empty.
+		invalid string
+	}{
+		{
+			name: "valid",
+			defs: []Definition{
+				{ID: "a", Dependency: "A", Install: install},
+				{ID: "b", Dependency: "B", Install: install, Requires: []Requirement{{ID: "a"}}},
+			},
+		},
+		{
+			name:    "missing installer",
+			defs:    []Definition{{ID: "a", Dependency: "A"}},
+			invalid: "definition 0 needs",
+		},
+		{
+			name: "defined twice",
+			defs: []Definition{
+				{ID: "a", Dependency: "A", Install: install},
+				{ID: "a", Dependency: "B", Install: install},
+			},
+			invalid: "a defined twice",
+		},
+		{
+			name:    "unknown requirement",
+			defs:    []Definition{{ID: "a", Dependency: "A", Install: install, Requires: []Requirement{{ID: "missing"}}}},
+			invalid: "a requires unknown missing",
+		},
+		{
+			name:    "requires itself",
+			defs:    []Definition{{ID: "a", Dependency: "A", Install: install, Requires: []Requirement{{ID: "a"}}}},
+			invalid: "cycle a -> a",
+		},
+		{
+			name: "cycle",
+			defs: []Definition{
+				{ID: "a", Dependency: "A", Install: install, Requires: []Requirement{{ID: "b"}}},
+				{ID: "b", Dependency: "B", Install: install, Requires: []Requirement{{ID: "c", Scope: AnyNode}}},
+				{ID: "c", Dependency: "C", Install: install, Requires: []Requirement{{ID: "a"}}},
+			},
+			invalid: "cycle a -> b -> c -> a",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := NewGraph(tc.defs...)
+
+			if tc.invalid == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrorInvalidGraph) || !strings.Contains(err.Error(), tc.invalid) {
+				t.Fatalf("got error %v, want %s", err, tc.invalid)
+			}
+		})
+	}
+}
+
+func TestSyncBlocksDependents(t *testing.T) {
+	a, b := newFakeInstaller(), newFakeInstaller()
+	a.errs["node-1"] = []error{errBroken}
+
+	g, err := NewGraph(
+		Definition{ID: "a", Dependency: "A", Install: a.Install},
+		Definition{ID: "b", Dependency: "B", Install: b.Install, Requires: []Requirement{{ID: "a"}}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := g.Sync(context.Background(), project([]string{"node-1", "node-2"}, "A", "B"))
+
+	if !errors.Is(err, ErrorFailing) || !errors.Is(err, ErrorBlocked) || !errors.Is(err, errBroken) {
+		t.Fatalf("got error %v, want node-1 failing and blocked", err)
+	}
+	if b.installs["node-1"] != 0 || b.installs["node-2"] != 1 {
+		t.Errorf("b installed %v, want only on node-2", b.installs)
+	}
+	if got := status(cfg, "node-1", "A"); got != ertia.DependencyStatusFailing {
+		t.Errorf("a on node-1 is %s, want failing", got)
+	}
+	if got := status(cfg, "node-1", "B"); got != ertia.DependencyStatusWaiting {
+		t.Errorf("b on node-1 is %s, want waiting", got)
+	}
+	if got := status(cfg, "node-2", "B"); got != ertia.DependencyStatusReady {
+		t.Errorf("b on node-2 is %s, want ready", got)
+	}
+}
+
+func TestSyncCollectsErrors(t *testing.T) {
+	a := newFakeInstaller()
+	a.errs["node-1"] = []error{errBroken}
+	a.errs["node-3"] = []error{errBroken}
+
+	g, err := NewGraph(Definition{ID: "a", Dependency: "A", Install: a.Install})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := g.Sync(context.Background(), project([]string{"node-1", "node-2", "node-3"}, "A"))
+
+	var errs Errors
+	if !errors.As(err, &errs) || len(errs) != 2 {
+		t.Fatalf("got error %v, want both failures", err)
+	}
+	var failed []string
+	for _, err := range errs {
+		var taskErr *TaskError
+		if !errors.As(err, &taskErr) || !errors.Is(taskErr, errBroken) {
+			t.Fatalf("got error %v, want a task error", err)
+		}
+		failed = append(failed, taskErr.Node)
+	}
+	if strings.Join(failed, ",") != "node-1,node-3" && strings.Join(failed, ",") != "node-3,node-1" {
+		t.Errorf("failed on %v, want node-1 and node-3", failed)
+	}
+	if got := status(cfg, "node-2", "A"); got != ertia.DependencyStatusReady {
+		t.Errorf("a on node-2 is %s, want ready", got)
+	}
+}
+
+func TestSyncStopsReinstallingOutdated(t *testing.T) {
+	a := newFakeInstaller()
+
+	g, err := NewGraph(Definition{
+		ID:         "a",
+		Dependency: "A",
+		Install:    a.Install,
+		Outdated:   func(cfg *ertia.Project, node *ertia.Node) bool { return true },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.Retry = RetryPolicy{MaxRetries: 3}
+
+	cfg, err := g.Sync(context.Background(), project([]string{"node-1"}, "A"))
+
+	if !errors.Is(err, ErrorFailing) || !strings.Contains(err.Error(), "still outdated after 3 installs") {
+		t.Fatalf("got error %v, want the dependency to stay outdated", err)
+	}
+	if a.installs["node-1"] != 4 {
+		t.Errorf("installed %d times, want once and 3 reinstalls", a.installs["node-1"])
+	}
+	if got := status(cfg, "node-1", "A"); got != ertia.DependencyStatusFailing {
+		t.Errorf("a is %s, want failing", got)
+	}
+}
@@ -0,0 +1,319 @@
+package dependencies
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+
+	ertia "github.com/ertia-io/config/pkg/entities"
+	"github.com/rs/zerolog/log"
+)
+
+// Project tag overriding how many nodes are installed at once, e.g.
+// dependency-concurrency:10.
+const concurrencyTag = "dependency-concurrency:"
+
+// DefaultConcurrency is the number of nodes NewGraph installs at once.
+const DefaultConcurrency = 5
+
+// ConcurrencyFor reads the concurrency from the project tags, falling back to
+// DefaultConcurrency.
+func ConcurrencyFor(ctx context.Context, cfg *ertia.Project) int {
+	c := DefaultConcurrency
+
+	for _, tag := range cfg.Tags {
+		if !strings.HasPrefix(tag, concurrencyTag) {
+			continue
+		}
+
+		n, err := strconv.Atoi(strings.TrimPrefix(tag, concurrencyTag))
+		if err != nil || n <= 0 {
+			log.Ctx(ctx).Warn().Str("tag", tag).Msg("Ignoring invalid concurrency")
+			continue
+		}
+		c = n
+	}
+
+	return c
+}
+
+// TaskError reports the dependency that failed on a node.
+type TaskError struct {
+	Node       string
+	Definition string
+	Err        error
+}
+
+func (e *TaskError) Error() string {
+	return fmt.Sprintf("%s: %s on %s: %v", ErrorFailing, e.Definition, e.Node, e.Err)
+}
+
+func (e *TaskError) Is(target error) bool {
+	return target == ErrorFailing
+}
+
+func (e *TaskError) Unwrap() error {
+	return e.Err
+}
+
+// Errors collects the failures of a sync, errors.Is and errors.As match any
+// of them.
+type Errors []error
+
+func (e Errors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (e Errors) Is(target error) bool {
+	for _, err := range e {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e Errors) As(target interface{}) bool {
+	for _, err := range e {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// err returns nil without errors and a single error as is.
+func (e Errors) err() error {
+	switch len(e) {
+	case 0:
+		return nil
+	case 1:
+		return e[0]
+	}
+	return e
+}
+
+// round runs the runnable tasks of one pass of Sync against the shared
+// project. Installers work on their own snapshot of the project, what they
+// change is merged back one at a time.
+type round struct {
+	g *Graph
+
+	mu  sync.Mutex
+	cfg *ertia.Project
+
+	// attempt is the fewest attempts of the tasks to retry, zero when
+	// there are none.
+	attempt int32
+	errs    Errors
+}
+
+// serial runs the tasks one after another on the shared project.
+func (r *round) serial(ctx context.Context, tasks []task) error {
+	for _, t := range tasks {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		before := snapshot(r.cfg)
+		result, err := r.g.run(ctx, snapshot(before), t)
+		r.record(ctx, t, before, result, err)
+	}
+	return ctx.Err()
+}
+
+// parallel runs the tasks on at most g.Concurrency nodes at once.
+func (r *round) parallel(ctx context.Context, tasks []task) error {
+	limit := r.g.Concurrency
+	if limit <= 0 {
+		limit = 1
+	}
+	sem := make(chan struct{}, limit)
+
+	var wg sync.WaitGroup
+	for _, t := range tasks {
+		if ctx.Err() != nil {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			continue
+		case sem <- struct{}{}:
+			wg.Add(1)
+			go func(t task) {
+				defer wg.Done()
+				defer func() { <-sem }()
+
+				r.mu.Lock()
+				before := snapshot(r.cfg)
+				r.mu.Unlock()
+
+				result, err := r.g.run(ctx, snapshot(before), t)
+				r.record(ctx, t, before, result, err)
+			}(t)
+		}
+	}
+	wg.Wait()
+
+	return ctx.Err()
+}
+
+// record merges what the task changed relative to before into the shared
+// project and keeps track of what failed.
+func (r *round) record(ctx context.Context, t task, before, result *ertia.Project, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if result != nil {
+		merge(r.cfg, before, result)
+	}
+
+	if err == nil || ctx.Err() != nil {
+		return
+	}
+
+	if errors.Is(err, ErrorNotReady) {
+		var retries int32
+		r.cfg, retries = r.g.retry(ctx, r.cfg, t, err)
+		if retries >= r.g.Retry.MaxRetries {
+			r.errs = append(r.errs, r.taskError(t, err))
+		} else if r.attempt == 0 || retries < r.attempt {
+			r.attempt = retries
+		}
+		return
+	}
+
+	// Failed readiness checks have marked the dependency already, any
+	// other error is final too so the dependency is not picked up again.
+	node := r.cfg.FindNodeByID(t.nodeID)
+	if node.Requires(t.def.Dependency) {
+		setStatus(node, t.def.Dependency, ertia.DependencyStatusFailing)
+		node.Error = err.Error()
+		r.cfg = r.cfg.UpdateNode(node)
+	}
+	log.Ctx(ctx).Error().Err(err).Str("node", node.Name).Str("dependency", t.def.ID).Msg("Dependency failed")
+
+	r.errs = append(r.errs, r.taskError(t, err))
+}
+
+func (r *round) taskError(t task, err error) error {
+	return &TaskError{Node: r.cfg.FindNodeByID(t.nodeID).Name, Definition: t.def.ID, Err: err}
+}
+
+// snapshot copies the project deep enough for an installer to change it
+// without touching the shared project.
+func snapshot(cfg *ertia.Project) *ertia.Project {
+	snap := *cfg
+	snap.Tags = append([]string(nil), cfg.Tags...)
+	snap.Deployments = append([]ertia.Deployment(nil), cfg.Deployments...)
+	snap.Provisionings = append([]ertia.Provisioning(nil), cfg.Provisionings...)
+	if cfg.DNS != nil {
+		dns := *cfg.DNS
+		snap.DNS = &dns
+	}
+	if cfg.SSHKey != nil {
+		key := *cfg.SSHKey
+		snap.SSHKey = &key
+	}
+	snap.Nodes = make([]ertia.Node, len(cfg.Nodes))
+	for i, node := range cfg.Nodes {
+		node.Tags = append([]string(nil), node.Tags...)
+		node.Dependencies = append([]ertia.Dependency(nil), node.Dependencies...)
+		snap.Nodes[i] = node
+	}
+	return &snap
+}
+
+// merge applies the changes result made to before onto cfg: the fields of
+// the project and the fields of every node, with tags and node dependencies
+// merged by entry. Changes other tasks made to cfg in the meantime are kept
+// unless result changed the same field. Nodes result added or removed are
+// not merged.
+func merge(cfg, before, result *ertia.Project) {
+	tags, nodes := cfg.Tags, cfg.Nodes
+	mergeFields(cfg, before, result)
+	cfg.Tags = mergeTags(tags, before.Tags, result.Tags)
+	cfg.Nodes = nodes
+
+	for i := range result.Nodes {
+		after := &result.Nodes[i]
+		old, node := before.FindNodeByID(after.ID), cfg.FindNodeByID(after.ID)
+		if old == nil || node == nil {
+			continue
+		}
+
+		tags, deps := node.Tags, node.Dependencies
+		mergeFields(node, old, after)
+		node.Tags = mergeTags(tags, old.Tags, after.Tags)
+		node.Dependencies = mergeDependencies(deps, old.Dependencies, after.Dependencies)
+	}
+}
+
+// mergeFields sets the fields of the struct dst points to that differ
+// between the structs was and now point to.
+func mergeFields(dst, was, now interface{}) {
+	d, w, n := reflect.ValueOf(dst).Elem(), reflect.ValueOf(was).Elem(), reflect.ValueOf(now).Elem()
+	for f := 0; f < n.NumField(); f++ {
+		if !reflect.DeepEqual(w.Field(f).Interface(), n.Field(f).Interface()) {
+			d.Field(f).Set(n.Field(f))
+		}
+	}
+}
+
+// mergeTags removes the tags dropped from before to after from tags and adds
+// the ones after added.
+func mergeTags(tags, before, after []string) []string {
+	merged := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		if !hasTag(before, tag) || hasTag(after, tag) {
+			merged = append(merged, tag)
+		}
+	}
+	for _, tag := range after {
+		if !hasTag(before, tag) && !hasTag(merged, tag) {
+			merged = append(merged, tag)
+		}
+	}
+	return merged
+}
+
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeDependencies sets the dependencies that changed from before to after
+// in deps.
+func mergeDependencies(deps, before, after []ertia.Dependency) []ertia.Dependency {
+	merged := append([]ertia.Dependency(nil), deps...)
+
+Changed:
+	for _, dep := range after {
+		for _, old := range before {
+			if old == dep {
+				continue Changed
+			}
+		}
+		for i := range merged {
+			if merged[i].Name == dep.Name {
+				merged[i] = dep
+				continue Changed
+			}
+		}
+		merged = append(merged, dep)
+	}
+	return merged
+}
@@ -0,0 +1,95 @@
+package dependencies
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	ertia "github.com/ertia-io/config/pkg/entities"
+	"github.com/rs/zerolog"
+)
+
+func TestMerge(t *testing.T) {
+	cfg := &ertia.Project{
+		Tags:       []string{"ertia.state/helm-chart:a=1"},
+		K3SChannel: "stable",
+		DNS:        &ertia.DNS{Domain: ".apps.example.com"},
+		SSHKey:     &ertia.SSHKey{Name: "project"},
+		Nodes: []ertia.Node{
+			{ID: "server", Tags: []string{"role:server"}},
+			{ID: "agent", Dependencies: []ertia.Dependency{{Name: "k3s", Status: "pending"}}},
+		},
+	}
+	before := snapshot(cfg)
+
+	// Another task records the host key of the server meanwhile.
+	cfg.Nodes[0].Tags = append(cfg.Nodes[0].Tags, "ertia.state/ssh-host-key:other")
+	cfg.SSHKey = &ertia.SSHKey{Name: "project", ProviderID: "42"}
+
+	result := snapshot(before)
+	result.Tags = []string{"ertia.state/helm-chart:a=2"}
+	result.Nodes[0].Tags = append(result.Nodes[0].Tags, "ertia.state/private-ipv4:10.0.0.2")
+	result.Nodes[1].IPV4 = net.ParseIP("192.0.2.1")
+	result.Nodes[1].Dependencies[0].Status = "ready"
+	result.K3SChannel = "latest"
+	result.DNS.Status = ertia.DNSStatusReady
+
+	merge(cfg, before, result)
+
+	if want := []string{"ertia.state/helm-chart:a=2"}; !reflect.DeepEqual(cfg.Tags, want) {
+		t.Errorf("project tags %v, want %v", cfg.Tags, want)
+	}
+	if want := []string{"role:server", "ertia.state/ssh-host-key:other", "ertia.state/private-ipv4:10.0.0.2"}; !reflect.DeepEqual(cfg.Nodes[0].Tags, want) {
+		t.Errorf("server tags %v, want %v", cfg.Nodes[0].Tags, want)
+	}
+	if !cfg.Nodes[1].IPV4.Equal(net.ParseIP("192.0.2.1")) {
+		t.Errorf("agent IPv4 %v not merged", cfg.Nodes[1].IPV4)
+	}
+	if cfg.Nodes[1].Dependencies[0].Status != "ready" {
+		t.Errorf("agent dependency %v not merged", cfg.Nodes[1].Dependencies)
+	}
+	if cfg.K3SChannel != "latest" || cfg.DNS.Status != ertia.DNSStatusReady {
+		t.Errorf("project channel %s and DNS %+v not merged", cfg.K3SChannel, cfg.DNS)
+	}
+	if cfg.SSHKey.ProviderID != "42" {
+		t.Errorf("key %+v registered meanwhile was lost", cfg.SSHKey)
+	}
+	if before.DNS.Status == ertia.DNSStatusReady {
+		t.Error("snapshot shares the DNS of the project")
+	}
+}
+
+func TestConcurrencyFor(t *testing.T) {
+	var logs bytes.Buffer
+	logger := zerolog.New(&logs)
+	ctx := logger.WithContext(context.Background())
+
+	cases := []struct {
+		name string
+		tags []string
+		want int
+
+		// logged is expected in the context logger, nothing when empty.
+		logged string
+	}{
+		{name: "default", want: DefaultConcurrency},
+		{name: "tag", tags: []string{"dependency-concurrency:10"}, want: 10},
+		{name: "invalid tag", tags: []string{"dependency-concurrency:-1"}, want: DefaultConcurrency, logged: "dependency-concurrency:-1"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			logs.Reset()
+
+			if got := ConcurrencyFor(ctx, &ertia.Project{Tags: tc.tags}); got != tc.want {
+				t.Errorf("got concurrency %d, want %d", got, tc.want)
+			}
+			if tc.logged == "" && logs.Len() > 0 || !strings.Contains(logs.String(), tc.logged) {
+				t.Errorf("logged %q, want %q", logs.String(), tc.logged)
+			}
+		})
+	}
+}
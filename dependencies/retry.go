@@ -0,0 +1,74 @@
+package dependencies
+
+import (
+	"context"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	ertia "github.com/ertia-io/config/pkg/entities"
+	"github.com/rs/zerolog/log"
+)
+
+// Project tag overriding the retry limit, e.g. dependency-retries:20.
+const retriesTag = "dependency-retries:"
+
+// RetryPolicy bounds how often and how fast a dependency that is not ready
+// is installed again.
+type RetryPolicy struct {
+	// MaxRetries is the number of attempts after which the dependency is
+	// marked failing.
+	MaxRetries int32
+
+	// Initial is the delay after the first attempt, it doubles with every
+	// attempt up to Max.
+	Initial time.Duration
+	Max     time.Duration
+}
+
+// DefaultRetryPolicy is used by NewGraph.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxRetries: 10,
+	Initial:    time.Second,
+	Max:        time.Minute,
+}
+
+// RetryPolicyFor reads the retry limit from the project tags, falling back to
+// DefaultRetryPolicy.
+func RetryPolicyFor(ctx context.Context, cfg *ertia.Project) RetryPolicy {
+	r := DefaultRetryPolicy
+
+	for _, tag := range cfg.Tags {
+		if !strings.HasPrefix(tag, retriesTag) {
+			continue
+		}
+
+		n, err := strconv.ParseInt(strings.TrimPrefix(tag, retriesTag), 10, 32)
+		if err != nil || n <= 0 {
+			log.Ctx(ctx).Warn().Str("tag", tag).Msg("Ignoring invalid retry limit")
+			continue
+		}
+		r.MaxRetries = int32(n)
+	}
+
+	return r
+}
+
+// backoff returns the delay before the next attempt, between half and all of
+// the doubled delay so nodes retrying together spread out.
+func (r RetryPolicy) backoff(attempt int32) time.Duration {
+	d := r.Initial
+	for i := int32(1); i < attempt && d < r.Max; i++ {
+		d *= 2
+	}
+	if d > r.Max {
+		d = r.Max
+	}
+	if d <= 0 {
+		return 0
+	}
+
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(d-half)+1))
+}
@@ -0,0 +1,121 @@
+package dependencies
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	ertia "github.com/ertia-io/config/pkg/entities"
+	"github.com/rs/zerolog"
+)
+
+func TestRetryPolicyFor(t *testing.T) {
+	var logs bytes.Buffer
+	logger := zerolog.New(&logs)
+	ctx := logger.WithContext(context.Background())
+
+	cases := []struct {
+		name string
+		tags []string
+		want int32
+
+		// logged is expected in the context logger, nothing when empty.
+		logged string
+	}{
+		{name: "default", want: DefaultRetryPolicy.MaxRetries},
+		{name: "tag", tags: []string{"dependency-retries:20"}, want: 20},
+		{name: "invalid tag", tags: []string{"dependency-retries:many"}, want: DefaultRetryPolicy.MaxRetries, logged: "dependency-retries:many"},
+		{name: "zero", tags: []string{"dependency-retries:0"}, want: DefaultRetryPolicy.MaxRetries, logged: "dependency-retries:0"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			logs.Reset()
+
+			if got := RetryPolicyFor(ctx, &ertia.Project{Tags: tc.tags}).MaxRetries; got != tc.want {
+				t.Errorf("got %d retries, want %d", got, tc.want)
+			}
+			if tc.logged == "" && logs.Len() > 0 || !strings.Contains(logs.String(), tc.logged) {
+				t.Errorf("logged %q, want %q", logs.String(), tc.logged)
+			}
+		})
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	r := RetryPolicy{Initial: time.Second, Max: 10 * time.Second}
+
+	cases := []struct {
+		attempt  int32
+		min, max time.Duration
+	}{
+		{attempt: 1, min: 500 * time.Millisecond, max: time.Second},
+		{attempt: 2, min: time.Second, max: 2 * time.Second},
+		{attempt: 4, min: 4 * time.Second, max: 8 * time.Second},
+		{attempt: 5, min: 5 * time.Second, max: 10 * time.Second},
+		{attempt: 50, min: 5 * time.Second, max: 10 * time.Second},
+	}
+
+	for _, tc := range cases {
+		for i := 0; i < 100; i++ {
+			if d := r.backoff(tc.attempt); d < tc.min || d > tc.max {
+				t.Fatalf("attempt %d waits %s, want between %s and %s", tc.attempt, d, tc.min, tc.max)
+			}
+		}
+	}
+
+	if d := (RetryPolicy{}).backoff(3); d != 0 {
+		t.Errorf("got backoff %s without delays, want none", d)
+	}
+}
+
+func TestSyncRetriesNotReady(t *testing.T) {
+	notReady := fmt.Errorf("%w: ssh not up", ErrorNotReady)
+
+	cases := []struct {
+		name     string
+		failures int
+
+		installs int
+		status   string
+		retries  int32
+	}{
+		{name: "ready after retries", failures: 2, installs: 3, status: ertia.DependencyStatusReady},
+		{name: "retries used up", failures: 5, installs: 3, status: ertia.DependencyStatusFailing, retries: 3},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			a := newFakeInstaller()
+			for i := 0; i < tc.failures; i++ {
+				a.errs["node-1"] = append(a.errs["node-1"], notReady)
+			}
+
+			g, err := NewGraph(Definition{ID: "a", Dependency: "A", Install: a.Install})
+			if err != nil {
+				t.Fatal(err)
+			}
+			g.Retry = RetryPolicy{MaxRetries: 3}
+
+			cfg, err := g.Sync(context.Background(), project([]string{"node-1"}, "A"))
+
+			if tc.status == ertia.DependencyStatusFailing {
+				var taskErr *TaskError
+				if !errors.As(err, &taskErr) || !errors.Is(err, ErrorNotReady) {
+					t.Fatalf("got error %v, want the retries used up", err)
+				}
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			dep := dependency(cfg.FindNodeByID("node-1"), "A")
+			if a.installs["node-1"] != tc.installs || dep.Status != tc.status || dep.Retries != tc.retries {
+				t.Errorf("installed %d times, dependency %+v, want %d installs, %s after %d retries", a.installs["node-1"], dep, tc.installs, tc.status, tc.retries)
+			}
+		})
+	}
+}
@@ -0,0 +1,80 @@
+package providers
+
+import (
+	"context"
+	"time"
+
+	ertia "github.com/ertia-io/config/pkg/entities"
+	"github.com/ertia-io/providers/dependencies"
+	"github.com/ertia-io/providers/k3s"
+	"github.com/ertia-io/providers/redact"
+	"github.com/rs/zerolog/log"
+)
+
+// DrainNode cordons the node and evicts its pods, respecting
+// PodDisruptionBudgets, before its server is stopped or deleted. Nodes that
+// never joined the cluster are left alone.
+func DrainNode(ctx context.Context, p NodeProvider, cfg *ertia.Project, node *ertia.Node, timeout time.Duration) error {
+	defer redact.Project(cfg)()
+
+	if !node.Fulfils(dependencies.K3SDependency.Name) {
+		return nil
+	}
+
+	server := controlNode(cfg, *node)
+	if server == nil {
+		log.Ctx(ctx).Warn().Str("node", node.Name).Msg("No ready server to drain node through")
+		return nil
+	}
+
+	opts := k3sInstallOptions(ctx, p, cfg, server)
+	err := opts.TrustHostKey(ctx, server)
+	if err != nil {
+		return err
+	}
+
+	log.Ctx(ctx).Info().Str("node", node.Name).Msg("Draining node")
+	return k3s.DrainNode(ctx, opts.Connector(), *server, node.Name, timeout)
+}
+
+// UncordonNode makes a previously drained node schedulable again.
+func UncordonNode(ctx context.Context, p NodeProvider, cfg *ertia.Project, node *ertia.Node) error {
+	defer redact.Project(cfg)()
+
+	if !node.Fulfils(dependencies.K3SDependency.Name) {
+		return nil
+	}
+
+	server := controlNode(cfg, *node)
+	if server == nil {
+		return nil
+	}
+
+	opts := k3sInstallOptions(ctx, p, cfg, server)
+	err := opts.TrustHostKey(ctx, server)
+	if err != nil {
+		return err
+	}
+
+	return k3s.UncordonNode(ctx, opts.Connector(), *server, node.Name)
+}
+
+// RemoveClusterNode deletes the node object once its server is gone. Failures
+// are only logged, the server is already deleted at this point.
+func RemoveClusterNode(ctx context.Context, p NodeProvider, cfg *ertia.Project, node *ertia.Node) {
+	defer redact.Project(cfg)()
+
+	server := controlNode(cfg, *node)
+	if server == nil || server.ID == node.ID {
+		return
+	}
+
+	opts := k3sInstallOptions(ctx, p, cfg, server)
+	err := opts.TrustHostKey(ctx, server)
+	if err == nil {
+		err = k3s.RemoveNode(ctx, opts.Connector(), *server, node.Name)
+	}
+	if err != nil {
+		log.Ctx(ctx).Warn().Err(err).Str("node", node.Name).Msg("Could not remove node from cluster")
+	}
+}
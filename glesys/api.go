@@ -0,0 +1,80 @@
+package glesys
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/ertia-io/providers/redact"
+)
+
+const glesysAPIURL = "https://api.glesys.com/"
+
+// apiClient talks to the parts of the GleSYS API that glesys-go does not cover.
+type apiClient struct {
+	project string
+	apiKey  string
+	baseURL string
+	http    *http.Client
+}
+
+func newAPIClient(project, apiKey string) *apiClient {
+	redact.Keep(apiKey)
+	return &apiClient{
+		project: project,
+		apiKey:  apiKey,
+		baseURL: glesysAPIURL,
+		http:    http.DefaultClient,
+	}
+}
+
+func (c *apiClient) post(ctx context.Context, path string, v interface{}, params interface{}) error {
+	buffer := new(bytes.Buffer)
+	if params != nil {
+		if err := json.NewEncoder(buffer).Encode(params); err != nil {
+			return err
+		}
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+path, buffer)
+	if err != nil {
+		return err
+	}
+
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", ErtiaUserAgent)
+	request.SetBasicAuth(c.project, c.apiKey)
+
+	response, err := c.http.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		data := struct {
+			Response struct {
+				Status struct {
+					Text string `json:"text"`
+				} `json:"status"`
+			} `json:"response"`
+		}{}
+		_ = json.Unmarshal(body, &data)
+		return fmt.Errorf("%s failed with HTTP error: %v (%v)", path, response.StatusCode, strings.TrimSpace(data.Response.Status.Text))
+	}
+
+	if v == nil {
+		return nil
+	}
+
+	return json.Unmarshal(body, v)
+}
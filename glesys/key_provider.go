@@ -2,17 +2,25 @@ package glesys
 
 import (
 	"context"
-	cfg "github.com/ertia-io/config/pkg/entities"
+	"fmt"
+	"strconv"
+
+	ertia "github.com/ertia-io/config/pkg/entities"
 	"github.com/glesys/glesys-go/v3"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/ssh"
 )
 
 type GlesysKeyProvider struct {
 	Client *glesys.Client
+
+	api *apiClient
 }
 
-func NewKeyProvider(cfg *cfg.Project) *GlesysKeyProvider {
+func NewKeyProvider(cfg *ertia.Project) *GlesysKeyProvider {
 	return &GlesysKeyProvider{
 		Client: glesys.NewClient(cfg.ProviderID, cfg.ProviderToken, ErtiaUserAgent),
+		api:    newAPIClient(cfg.ProviderID, cfg.ProviderToken),
 	}
 }
 
@@ -20,14 +28,136 @@ func (p *GlesysKeyProvider) Name() string {
 	return "glesys"
 }
 
-func (p *GlesysKeyProvider) CreateKey(ctx context.Context, cfg *cfg.Project, key *cfg.SSHKey) (*cfg.Project, error) {
-	return cfg, nil
+func (p *GlesysKeyProvider) CreateKey(ctx context.Context, cfg *ertia.Project, key *ertia.SSHKey) (*ertia.Project, error) {
+	key.Status = ertia.KeyStatusAdapting
+
+	cfg = cfg.UpdateKey(key)
+
+	// Parsed before registering, so a broken key is not left on the account.
+	fingerprint, err := fingerprintOf(key.PublicKey)
+	if err != nil {
+		log.Ctx(ctx).Error().Err(err).Send()
+		key.Status = ertia.KeyStatusFailing
+		key.Error = err.Error()
+		return cfg.UpdateKey(key), err
+	}
+
+	//Register the key on the GleSYS account.
+	result, err := p.api.addSSHKey(ctx, key.Name, key.PublicKey)
+	if err != nil {
+		log.Ctx(ctx).Error().Err(err).Send()
+		key.Status = ertia.KeyStatusFailing
+		key.Error = err.Error()
+		return cfg.UpdateKey(key), err
+	}
+
+	key.ProviderID = strconv.Itoa(result.ID)
+	key.Status = ertia.KeyStatusActive
+	key.Fingerprint = fingerprint
+	key.Error = ""
+
+	return cfg.UpdateKey(key), nil
 }
 
-func (p *GlesysKeyProvider) DeleteKey(ctx context.Context, cfg *cfg.Project) (*cfg.Project, error) {
-	return cfg, nil
+func (p *GlesysKeyProvider) DeleteKey(ctx context.Context, cfg *ertia.Project) (*ertia.Project, error) {
+	key := cfg.SSHKey
+
+	// The key never made it to the account.
+	if key.ProviderID == "" {
+		key.Status = ertia.KeyStatusDeleted
+		return cfg.UpdateKey(key), nil
+	}
+
+	pid, err := strconv.Atoi(key.ProviderID)
+	if err != nil {
+		return cfg, err
+	}
+
+	err = p.api.removeSSHKey(ctx, pid)
+	if err != nil {
+		return cfg, err
+	}
+
+	key.Status = ertia.KeyStatusDeleted
+	return cfg.UpdateKey(key), nil
 }
 
-func (p *GlesysKeyProvider) SyncKeys(ctx context.Context, cfg *cfg.Project) (*cfg.Project, error) {
+func (p *GlesysKeyProvider) SyncKeys(ctx context.Context, cfg *ertia.Project) (*ertia.Project, error) {
+	var err error
+	switch cfg.SSHKey.Status {
+	case ertia.KeyStatusNew:
+		cfg, err = p.CreateKey(ctx, cfg, cfg.SSHKey)
+		if err != nil {
+			log.Ctx(ctx).Err(err).Send()
+			return cfg, err
+		}
+	case ertia.KeyStatusActive:
+		// Register the key again if it was removed from the account.
+		keys, err := p.api.listSSHKeys(ctx)
+		if err != nil {
+			return cfg, err
+		}
+
+		for _, k := range keys {
+			if strconv.Itoa(k.ID) == cfg.SSHKey.ProviderID {
+				return cfg, nil
+			}
+		}
+
+		log.Ctx(ctx).Warn().Str("key", cfg.SSHKey.Name).Msg("SSH key missing on GleSYS, registering it again")
+		cfg, err = p.CreateKey(ctx, cfg, cfg.SSHKey)
+		if err != nil {
+			log.Ctx(ctx).Err(err).Send()
+			return cfg, err
+		}
+	}
+
 	return cfg, nil
 }
+
+type sshKey struct {
+	ID          int    `json:"id"`
+	Account     string `json:"account"`
+	Description string `json:"description"`
+	Data        string `json:"data"`
+}
+
+func (c *apiClient) addSSHKey(ctx context.Context, description, publicKey string) (*sshKey, error) {
+	data := struct {
+		Response struct {
+			SSHKey sshKey `json:"sshkey"`
+		} `json:"response"`
+	}{}
+
+	err := c.post(ctx, "sshkey/add", &data, map[string]string{
+		"description": description,
+		"sshkey":      publicKey,
+	})
+	return &data.Response.SSHKey, err
+}
+
+func (c *apiClient) listSSHKeys(ctx context.Context) ([]sshKey, error) {
+	data := struct {
+		Response struct {
+			SSHKeys []sshKey `json:"sshkeys"`
+		} `json:"response"`
+	}{}
+
+	err := c.post(ctx, "sshkey/list", &data, nil)
+	return data.Response.SSHKeys, err
+}
+
+func (c *apiClient) removeSSHKey(ctx context.Context, id int) error {
+	return c.post(ctx, "sshkey/remove", nil, map[string][]int{
+		"sshkeyids": {id},
+	})
+}
+
+func fingerprintOf(publicKey string) (string, error) {
+	pk, _, _, _, err := ssh.ParseAuthorizedKey([]byte(publicKey))
+	if err != nil {
+		return "", fmt.Errorf("could not parse public key: %w", err)
+	}
+
+	return ssh.FingerprintSHA256(pk), nil
+}
@@ -0,0 +1,128 @@
+package glesys
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+
+	ertia "github.com/ertia-io/config/pkg/entities"
+	"golang.org/x/crypto/ssh"
+)
+
+func testPublicKey(t *testing.T) (string, string) {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(ssh.MarshalAuthorizedKey(pk)), ssh.FingerprintSHA256(pk)
+}
+
+func TestCreateKey(t *testing.T) {
+	publicKey, fingerprint := testPublicKey(t)
+
+	cases := []struct {
+		name      string
+		publicKey string
+		responses map[string]string
+
+		status      string
+		providerID  string
+		fingerprint string
+		registered  bool
+	}{
+		{
+			name:        "registered",
+			publicKey:   publicKey,
+			responses:   map[string]string{"sshkey/add": `{"response": {"sshkey": {"id": 42}}}`},
+			status:      ertia.KeyStatusActive,
+			providerID:  "42",
+			fingerprint: fingerprint,
+			registered:  true,
+		},
+		{
+			name:      "invalid key is not registered",
+			publicKey: "not a key",
+			status:    ertia.KeyStatusFailing,
+		},
+		{
+			name:       "registration refused",
+			publicKey:  publicKey,
+			responses:  map[string]string{"sshkey/add": "error:Invalid key"},
+			status:     ertia.KeyStatusFailing,
+			registered: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			api := newFakeAPI(tc.responses)
+			p := &GlesysKeyProvider{api: api.client(t)}
+
+			key := &ertia.SSHKey{Name: "project", PublicKey: tc.publicKey, Status: ertia.KeyStatusNew}
+			cfg, err := p.CreateKey(context.Background(), &ertia.Project{SSHKey: key}, key)
+
+			if (err != nil) != (tc.status == ertia.KeyStatusFailing) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if cfg.SSHKey.Status != tc.status || cfg.SSHKey.ProviderID != tc.providerID || cfg.SSHKey.Fingerprint != tc.fingerprint {
+				t.Errorf("got key %+v, want status %s, provider id %q, fingerprint %q", cfg.SSHKey, tc.status, tc.providerID, tc.fingerprint)
+			}
+			if registered := len(api.posted) > 0; registered != tc.registered {
+				t.Errorf("key registered %v, want %v", registered, tc.registered)
+			}
+		})
+	}
+}
+
+func TestDeleteKey(t *testing.T) {
+	cases := []struct {
+		name       string
+		providerID string
+		removed    bool
+	}{
+		{name: "registered key", providerID: "42", removed: true},
+		{name: "key never created", providerID: ""},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			api := newFakeAPI(map[string]string{"sshkey/remove": `{"response": {}}`})
+			p := &GlesysKeyProvider{api: api.client(t)}
+
+			cfg, err := p.DeleteKey(context.Background(), &ertia.Project{SSHKey: &ertia.SSHKey{ProviderID: tc.providerID}})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if cfg.SSHKey.Status != ertia.KeyStatusDeleted {
+				t.Errorf("key status %s, want %s", cfg.SSHKey.Status, ertia.KeyStatusDeleted)
+			}
+			if removed := len(api.posted["sshkey/remove"]) > 0; removed != tc.removed {
+				t.Errorf("key removed %v, want %v", removed, tc.removed)
+			}
+		})
+	}
+}
+
+func TestSyncKeysRegistersMissingKey(t *testing.T) {
+	publicKey, _ := testPublicKey(t)
+
+	api := newFakeAPI(map[string]string{
+		"sshkey/list": `{"response": {"sshkeys": [{"id": 7}]}}`,
+		"sshkey/add":  `{"response": {"sshkey": {"id": 43}}}`,
+	})
+	p := &GlesysKeyProvider{api: api.client(t)}
+
+	key := &ertia.SSHKey{ProviderID: "42", PublicKey: publicKey, Status: ertia.KeyStatusActive}
+	cfg, err := p.SyncKeys(context.Background(), &ertia.Project{SSHKey: key})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.SSHKey.ProviderID != "43" {
+		t.Errorf("key provider id %s, want it registered again as 43", cfg.SSHKey.ProviderID)
+	}
+}
@@ -2,14 +2,14 @@ package glesys
 
 import (
 	"context"
-	"errors"
-	"fmt"
 	"net"
 	"time"
 
 	ertia "github.com/ertia-io/config/pkg/entities"
+	"github.com/ertia-io/providers"
 	"github.com/ertia-io/providers/dependencies"
 	"github.com/ertia-io/providers/k3s"
+	"github.com/ertia-io/providers/redact"
 	"github.com/glesys/glesys-go/v3"
 	"github.com/rs/zerolog/log"
 	"k8s.io/apimachinery/pkg/util/uuid"
@@ -17,53 +17,206 @@ import (
 
 const ErtiaUserAgent = "ERTIA: Frictionless Kubernetes"
 
-var DefaultGlesysNode = glesys.CreateServerParams{
-	Bandwidth:    100,
-	CampaignCode: "",
-	CPU:          8,
-	DataCenter:   "Falkenberg",
-	Memory:       12288,
-	Platform:     "KVM",
-	Storage:      150,
-	IPv4:         "any",
-	IPv6:         "any",
-	Template:     "debian-11",
+type GlesysNodeProvider struct {
+	Client          *glesys.Client
+	DefaultTemplate NodeTemplate
+	Templates       map[string]NodeTemplate
+	DrainTimeout    time.Duration
+
+	// ControlPlaneEndpoint is a stable address (DNS name, floating or load
+	// balancer IP) in front of the servers that agents and kubeconfigs use.
+	// It is the default for projects without a control-plane-endpoint: tag.
+	ControlPlaneEndpoint string
+
+	K3SVersion      string
+	K3SServerConfig k3s.Config
+	K3SAgentConfig  k3s.Config
+	K3SConfigs      map[string]k3s.Config
+
+	// K3SProgress receives the phases of every k3s install.
+	K3SProgress chan<- k3s.Progress
+
+	// K3SConnect opens the connection k3s is installed through, SSH when
+	// unset.
+	K3SConnect k3s.Connector
+
+	// KubeconfigMergeInto is a kubeconfig the project clusters are added to.
+	KubeconfigMergeInto string
+
+	// HelmCharts are installed into every cluster once k3s is ready.
+	HelmCharts []k3s.HelmChart
+
+	api *apiClient
 }
 
-type GlesysNodeProvider struct {
-	Client *glesys.Client
+type NodeProviderOption func(p *GlesysNodeProvider) *GlesysNodeProvider
+
+// WithDefaultTemplate sets the template used for nodes that match no other template.
+func WithDefaultTemplate(t NodeTemplate) NodeProviderOption {
+	return func(p *GlesysNodeProvider) *GlesysNodeProvider {
+		p.DefaultTemplate = t
+		return p
+	}
 }
 
-func NewNodeProvider(cfg *ertia.Project) *GlesysNodeProvider {
-	return &GlesysNodeProvider{
-		Client: glesys.NewClient(cfg.ProviderID, cfg.ProviderToken, ErtiaUserAgent),
+// WithTemplate registers a template under a node tag or under MasterTemplate/AgentTemplate.
+func WithTemplate(name string, t NodeTemplate) NodeProviderOption {
+	return func(p *GlesysNodeProvider) *GlesysNodeProvider {
+		p.Templates[name] = t
+		return p
 	}
 }
 
+// WithControlPlaneEndpoint makes the cluster highly available behind the
+// given endpoint. Servers are started with embedded etcd and the endpoint as
+// TLS SAN, and agents join through it. Projects override the endpoint with a
+// control-plane-endpoint: tag.
+func WithControlPlaneEndpoint(endpoint string) NodeProviderOption {
+	return func(p *GlesysNodeProvider) *GlesysNodeProvider {
+		p.ControlPlaneEndpoint = endpoint
+		return p
+	}
+}
+
+// WithK3SVersion pins the exact k3s release installed on new nodes.
+// Without it new nodes get the version already running in the cluster.
+func WithK3SVersion(version string) NodeProviderOption {
+	return func(p *GlesysNodeProvider) *GlesysNodeProvider {
+		p.K3SVersion = version
+		return p
+	}
+}
+
+// WithK3SProgress subscribes to the progress of k3s installs. Events are
+// dropped while the channel is full, so it should be buffered.
+func WithK3SProgress(progress chan<- k3s.Progress) NodeProviderOption {
+	return func(p *GlesysNodeProvider) *GlesysNodeProvider {
+		p.K3SProgress = progress
+		return p
+	}
+}
+
+// WithK3SConnector installs k3s through the connector instead of SSH, e.g.
+// a k3stest.FakeExecutor in tests.
+func WithK3SConnector(connect k3s.Connector) NodeProviderOption {
+	return func(p *GlesysNodeProvider) *GlesysNodeProvider {
+		p.K3SConnect = connect
+		return p
+	}
+}
+
+// WithKubeconfigMergeInto adds the cluster of every project to the
+// kubeconfig at path, e.g. ~/.kube/config, next to its own kubeconfig.
+func WithKubeconfigMergeInto(path string) NodeProviderOption {
+	return func(p *GlesysNodeProvider) *GlesysNodeProvider {
+		p.KubeconfigMergeInto = path
+		return p
+	}
+}
+
+// WithHelmChart installs the chart into every cluster and upgrades it when
+// it changes.
+func WithHelmChart(chart k3s.HelmChart) NodeProviderOption {
+	return func(p *GlesysNodeProvider) *GlesysNodeProvider {
+		p.HelmCharts = append(p.HelmCharts, chart)
+		return p
+	}
+}
+
+// WithK3SServerConfig sets the default k3s config of server nodes, shared by
+// all projects. k3s-config: project and node tags are merged over it.
+func WithK3SServerConfig(c k3s.Config) NodeProviderOption {
+	return func(p *GlesysNodeProvider) *GlesysNodeProvider {
+		p.K3SServerConfig = c
+		return p
+	}
+}
+
+// WithK3SAgentConfig sets the default k3s config of agent nodes, shared by
+// all projects. k3s-config: project and node tags are merged over it.
+func WithK3SAgentConfig(c k3s.Config) NodeProviderOption {
+	return func(p *GlesysNodeProvider) *GlesysNodeProvider {
+		p.K3SAgentConfig = c
+		return p
+	}
+}
+
+// WithK3SConfig registers k3s config, e.g. node labels and taints, that is
+// merged into the config of nodes with the given tag.
+func WithK3SConfig(tag string, c k3s.Config) NodeProviderOption {
+	return func(p *GlesysNodeProvider) *GlesysNodeProvider {
+		p.K3SConfigs[tag] = c
+		return p
+	}
+}
+
+// WithDrain drains nodes from the cluster before they are stopped or deleted,
+// and removes deleted nodes from the cluster. Nodes that cannot be drained
+// within the timeout, e.g. because they are unreachable, are stopped or
+// deleted anyway. Disabled when timeout is zero.
+func WithDrain(timeout time.Duration) NodeProviderOption {
+	return func(p *GlesysNodeProvider) *GlesysNodeProvider {
+		p.DrainTimeout = timeout
+		return p
+	}
+}
+
+func NewNodeProvider(cfg *ertia.Project, opts ...NodeProviderOption) *GlesysNodeProvider {
+	p := &GlesysNodeProvider{
+		Client:          glesys.NewClient(cfg.ProviderID, cfg.ProviderToken, ErtiaUserAgent),
+		DefaultTemplate: templateFromParams(DefaultGlesysNode),
+		Templates:       map[string]NodeTemplate{},
+		K3SConfigs:      map[string]k3s.Config{},
+		api:             newAPIClient(cfg.ProviderID, cfg.ProviderToken),
+	}
+
+	for _, opt := range opts {
+		p = opt(p)
+	}
+
+	return p
+}
+
 func (p *GlesysNodeProvider) Name() string {
 	return "glesys"
 }
 
 func (p *GlesysNodeProvider) CreateNode(ctx context.Context, cfg *ertia.Project, node *ertia.Node) (*ertia.Project, error) {
-	defaultNode := DefaultGlesysNode
+	template := p.templateFor(node)
 
-	defaultNode.PublicKey = cfg.SSHKey.PublicKey
-	defaultNode.Hostname = node.Name
+	err := k3s.CheckUserTags(node.Tags)
+	if err == nil {
+		err = p.api.validateTemplate(ctx, template)
+	}
+	if err != nil {
+		log.Ctx(ctx).Error().Err(err).Send()
+		node.Status = ertia.NodeStatusFailing
+		node.Error = err.Error()
+		return cfg.UpdateNode(node), err
+	}
 
-	defaultNode.Password = string(uuid.NewUUID())
+	params := glesys.CreateServerParams{
+		Bandwidth:  template.Bandwidth,
+		CPU:        template.CPU,
+		DataCenter: template.DataCenter,
+		Memory:     template.Memory,
+		Platform:   template.Platform,
+		Storage:    template.Storage,
+		IPv4:       "any",
+		IPv6:       "any",
+		Template:   template.Template,
+		PublicKey:  cfg.SSHKey.PublicKey,
+		Hostname:   node.Name,
+		Password:   string(uuid.NewUUID()),
+	}
 
-	defaultNode.Users = []glesys.User{{
-		Username: "ertia",
-		PublicKeys: []string{
-			defaultNode.PublicKey,
-		},
-		Password: defaultNode.Password,
-	}}
+	params = params.WithUser("ertia", []string{params.PublicKey}, params.Password)
 
-	node.InstallPassword = defaultNode.Password
+	node.InstallPassword = params.Password
 	node.InstallUser = "ertia"
+	defer redact.Node(node)()
 
-	result, err := p.Client.Servers.Create(ctx, defaultNode)
+	result, err := p.Client.Servers.Create(ctx, params)
 
 	if err != nil {
 		log.Ctx(ctx).Error().Err(err).Send()
@@ -104,6 +257,34 @@ func (p *GlesysNodeProvider) CreateNode(ctx context.Context, cfg *ertia.Project,
 
 func (p *GlesysNodeProvider) DeleteNode(ctx context.Context, cfg *ertia.Project, nodeId string) (*ertia.Project, error) {
 	node := cfg.FindNodeByID(nodeId)
+
+	if p.DrainTimeout > 0 {
+		// Nodes are often deleted because they are dead, so one that
+		// cannot be drained is deleted all the same.
+		err := providers.DrainNode(ctx, p, cfg, node, p.DrainTimeout)
+		if err != nil {
+			log.Ctx(ctx).Warn().Err(err).Str("node", node.Name).Msg("Could not drain node, deleting it anyway")
+		}
+	}
+
+	cfg, err := p.DestroyServer(ctx, cfg, nodeId)
+	if err != nil {
+		return cfg, err
+	}
+
+	if p.DrainTimeout > 0 {
+		providers.RemoveClusterNode(ctx, p, cfg, node)
+	}
+	providers.RemoveKubeconfig(ctx, cfg, node, p.kubeconfigOptions(cfg))
+
+	return cfg, nil
+}
+
+// DestroyServer deletes the server of the node without draining it or
+// touching the cluster.
+func (p *GlesysNodeProvider) DestroyServer(ctx context.Context, cfg *ertia.Project, nodeId string) (*ertia.Project, error) {
+	node := cfg.FindNodeByID(nodeId)
+
 	err := p.Client.Servers.Destroy(ctx, node.ProviderID, glesys.DestroyServerParams{KeepIP: false})
 
 	if err != nil {
@@ -143,6 +324,13 @@ func (p *GlesysNodeProvider) StopNode(ctx context.Context, cfg *ertia.Project, n
 
 	node := cfg.FindNodeByID(nodeId)
 
+	if p.DrainTimeout > 0 {
+		err := providers.DrainNode(ctx, p, cfg, node, p.DrainTimeout)
+		if err != nil {
+			log.Ctx(ctx).Warn().Err(err).Str("node", node.Name).Msg("Could not drain node, stopping it anyway")
+		}
+	}
+
 	err := p.Client.Servers.Stop(ctx, node.ProviderID, glesys.StopServerParams{})
 	if err != nil {
 		log.Ctx(ctx).Error().Err(err).Send()
@@ -163,13 +351,19 @@ func (p *GlesysNodeProvider) StartNode(ctx context.Context, cfg *ertia.Project,
 		return cfg, err
 	}
 
+	if p.DrainTimeout > 0 {
+		err = providers.UncordonNode(ctx, p, cfg, node)
+		if err != nil {
+			log.Ctx(ctx).Warn().Err(err).Str("node", node.Name).Msg("Could not uncordon node")
+		}
+	}
+
 	node.Status = ertia.NodeStatusActive
 	return cfg.UpdateNode(node), nil
 }
 
 func (p *GlesysNodeProvider) ReplaceNode(ctx context.Context, cfg *ertia.Project, nodeId string) (*ertia.Project, error) {
-	node := cfg.FindNodeByID(nodeId)
-	return p.CreateNode(ctx, cfg, node)
+	return providers.ReplaceNode(ctx, p, cfg, nodeId)
 }
 
 func (p *GlesysNodeProvider) SyncNodes(ctx context.Context, cfg *ertia.Project) (*ertia.Project, error) {
@@ -190,101 +384,38 @@ func (p *GlesysNodeProvider) SyncNodes(ctx context.Context, cfg *ertia.Project)
 }
 
 func (p *GlesysNodeProvider) SyncDependencies(ctx context.Context, cfg *ertia.Project) (*ertia.Project, error) {
-
-	var err error
-
-	for {
-		allDone := true
-		for i := range cfg.Nodes {
-			if cfg.Nodes[i].Requires(dependencies.K3SDependency.Name) {
-				fmt.Printf("Node %s requires %s \n", cfg.Nodes[i].Name, dependencies.K3SDependency.Name)
-				allDone = false
-				if cfg.Nodes[i].IsMaster {
-					cfg, err = installK3SMaster(ctx, cfg, &cfg.Nodes[i])
-					if err != nil {
-						if errors.Is(err, k3s.ErrorSSHNotReady) {
-							err = nil
-							time.Sleep(1 * time.Second)
-							break
-						}
-						return cfg, err
-					}
-				} else {
-					if cfg.Nodes[i].MasterIP != nil && cfg.Nodes[i].NodeToken != "" {
-						err := k3s.InstallK3SAgent(ctx, cfg.Nodes[i], cfg.Nodes[i].MasterIP.String(), cfg.K3SChannel)
-						if err != nil {
-							if errors.Is(err, k3s.ErrorSSHNotReady) {
-								err = nil
-								time.Sleep(1 * time.Second)
-								break
-							}
-							return cfg, err
-						}
-
-						for di := range cfg.Nodes[i].Dependencies {
-							if cfg.Nodes[i].Dependencies[di].Name == dependencies.K3SDependency.Name {
-								cfg.Nodes[i].Dependencies[di].Status = ertia.DependencyStatusReady
-							}
-						}
-
-						cfg = cfg.UpdateNode(&cfg.Nodes[i])
-
-					} else {
-						masterNode := cfg.FindMasterNode()
-						if masterNode.Fulfils(dependencies.K3SDependency.Name) {
-							cfg.Nodes[i].MasterIP = masterNode.IPV4
-							cfg.Nodes[i].NodeToken = masterNode.NodeToken
-							err := k3s.InstallK3SAgent(ctx, cfg.Nodes[i], masterNode.IPV4.String(), cfg.K3SChannel)
-							if err != nil {
-								if errors.Is(err, k3s.ErrorSSHNotReady) {
-									err = nil
-									time.Sleep(1 * time.Second)
-									break
-								}
-								return cfg, err
-							}
-
-							for di := range cfg.Nodes[i].Dependencies {
-								if cfg.Nodes[i].Dependencies[di].Name == dependencies.K3SDependency.Name {
-									cfg.Nodes[i].Dependencies[di].Status = ertia.DependencyStatusReady
-								}
-							}
-
-							cfg = cfg.UpdateNode(&cfg.Nodes[i])
-
-						} else {
-							//TODO: Maybe keep track of dependency status?
-						}
-					}
-
-				}
-			}
-		}
-		if allDone {
-			fmt.Println("All dependencies handled")
-			break
-		}
-	}
-
-	return cfg, nil
+	return providers.SyncDependencies(ctx, p, cfg)
 }
 
-func boolAddr(b bool) *bool {
-	return &b
+// K3SHelmCharts returns the charts installed into the cluster.
+func (p *GlesysNodeProvider) K3SHelmCharts(cfg *ertia.Project) []k3s.HelmChart {
+	return p.HelmCharts
 }
 
-func installK3SMaster(ctx context.Context, cfg *ertia.Project, node *ertia.Node) (*ertia.Project, error) {
-	nodeToken, err := k3s.InstallK3SServer(ctx, node.IPV4, node.InstallUser, node.InstallPassword, cfg.K3SChannel)
-	if err != nil {
-		return cfg, err
+// K3SInstallOptions returns how k3s is installed on the node.
+func (p *GlesysNodeProvider) K3SInstallOptions(ctx context.Context, cfg *ertia.Project, node *ertia.Node) k3s.InstallOptions {
+	version := p.K3SVersion
+	if version == "" {
+		version = k3s.ClusterVersion(cfg)
 	}
 
-	for di := range node.Dependencies {
-		if node.Dependencies[di].Name == dependencies.K3SDependency.Name {
-			node.Dependencies[di].Status = ertia.DependencyStatusReady
-		}
+	return k3s.InstallOptions{
+		Channel:    cfg.K3SChannel,
+		Version:    version,
+		Endpoint:   k3s.EndpointFor(cfg, p.ControlPlaneEndpoint),
+		Config:     k3s.ConfigFor(ctx, cfg, node, p.K3SServerConfig, p.K3SAgentConfig, p.K3SConfigs),
+		SSH:        k3s.SSHConfigFor(cfg),
+		Connect:    p.K3SConnect,
+		Progress:   p.K3SProgress,
+		Timeouts:   k3s.TimeoutsFor(ctx, cfg),
+		Kubeconfig: p.kubeconfigOptions(cfg),
 	}
+}
 
-	node.NodeToken = nodeToken
-	return cfg.UpdateNode(node), nil
+func (p *GlesysNodeProvider) kubeconfigOptions(cfg *ertia.Project) k3s.KubeconfigOptions {
+	return k3s.KubeconfigOptions{Name: cfg.Name, ID: cfg.ID, MergeInto: p.KubeconfigMergeInto}
+}
+
+func boolAddr(b bool) *bool {
+	return &b
 }
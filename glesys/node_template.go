@@ -0,0 +1,223 @@
+package glesys
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	ertia "github.com/ertia-io/config/pkg/entities"
+	"github.com/glesys/glesys-go/v3"
+)
+
+var (
+	ErrorInvalidNodeTemplate = errors.New("Glesys.InvalidNodeTemplate")
+)
+
+const (
+	PlatformKVM    = "KVM"
+	PlatformVMware = "VMware"
+
+	MasterTemplate = "master"
+	AgentTemplate  = "agent"
+)
+
+// NodeTemplate describes the size and placement of a GleSYS server.
+// Memory is in MB, Storage in GB and Bandwidth in Mbit/s.
+type NodeTemplate struct {
+	CPU        int
+	Memory     int
+	Storage    int
+	Bandwidth  int
+	DataCenter string
+	Platform   string
+	Template   string
+}
+
+var DefaultNodeTemplate = NodeTemplate{
+	CPU:        8,
+	Memory:     12288,
+	Storage:    150,
+	Bandwidth:  100,
+	DataCenter: "Falkenberg",
+	Platform:   PlatformKVM,
+	Template:   "debian-11",
+}
+
+// DefaultGlesysNode holds the server parameters of DefaultNodeTemplate.
+// NewNodeProvider takes its default template from it, so changes made
+// before creating the provider still apply.
+//
+// Deprecated: use WithDefaultTemplate and WithTemplate to size servers.
+var DefaultGlesysNode = glesys.CreateServerParams{
+	Bandwidth:    DefaultNodeTemplate.Bandwidth,
+	CampaignCode: "",
+	CPU:          DefaultNodeTemplate.CPU,
+	DataCenter:   DefaultNodeTemplate.DataCenter,
+	Memory:       DefaultNodeTemplate.Memory,
+	Platform:     DefaultNodeTemplate.Platform,
+	Storage:      DefaultNodeTemplate.Storage,
+	IPv4:         "any",
+	IPv6:         "any",
+	Template:     DefaultNodeTemplate.Template,
+}
+
+// templateFromParams returns the template described by server parameters.
+func templateFromParams(params glesys.CreateServerParams) NodeTemplate {
+	return NodeTemplate{
+		CPU:        params.CPU,
+		Memory:     params.Memory,
+		Storage:    params.Storage,
+		Bandwidth:  params.Bandwidth,
+		DataCenter: params.DataCenter,
+		Platform:   params.Platform,
+		Template:   params.Template,
+	}
+}
+
+// templateFor picks the template for a node. Node tags are matched against the
+// configured templates first, then the node role (MasterTemplate/AgentTemplate),
+// then the default.
+func (p *GlesysNodeProvider) templateFor(node *ertia.Node) NodeTemplate {
+	for _, tag := range node.Tags {
+		if t, ok := p.Templates[tag]; ok {
+			return t
+		}
+	}
+
+	role := AgentTemplate
+	if node.IsMaster {
+		role = MasterTemplate
+	}
+	if t, ok := p.Templates[role]; ok {
+		return t
+	}
+
+	return p.DefaultTemplate
+}
+
+// allowedValues is one entry of the server/allowedarguments listing. GleSYS
+// returns either a flat list or a list per datacenter.
+type allowedValues struct {
+	all           []string
+	perDatacenter map[string][]string
+}
+
+func (a *allowedValues) UnmarshalJSON(b []byte) error {
+	var list []interface{}
+	if err := json.Unmarshal(b, &list); err == nil {
+		a.all = allowedStrings(list)
+		return nil
+	}
+
+	var perDatacenter map[string][]interface{}
+	if err := json.Unmarshal(b, &perDatacenter); err != nil {
+		// Not something we validate against.
+		return nil
+	}
+
+	a.perDatacenter = map[string][]string{}
+	for dc, values := range perDatacenter {
+		a.perDatacenter[dc] = allowedStrings(values)
+	}
+
+	return nil
+}
+
+func (a allowedValues) allows(datacenter, value string) bool {
+	// Nothing listed means there is nothing to validate against.
+	if a.all == nil && a.perDatacenter == nil {
+		return true
+	}
+
+	values := a.all
+	if a.perDatacenter != nil {
+		values = a.perDatacenter[datacenter]
+	}
+
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func allowedStrings(values []interface{}) []string {
+	strs := make([]string, 0, len(values))
+	for _, v := range values {
+		switch tv := v.(type) {
+		case string:
+			strs = append(strs, tv)
+		case float64:
+			strs = append(strs, strconv.FormatFloat(tv, 'f', -1, 64))
+		case map[string]interface{}:
+			if name, ok := tv["name"].(string); ok {
+				strs = append(strs, name)
+			}
+		}
+	}
+	return strs
+}
+
+type allowedArguments struct {
+	DataCenter allowedValues `json:"datacenter"`
+	CPU        allowedValues `json:"cpucores"`
+	Memory     allowedValues `json:"memorysize"`
+	Storage    allowedValues `json:"disksize"`
+	Bandwidth  allowedValues `json:"transfer"`
+	Template   allowedValues `json:"template"`
+}
+
+func (c *apiClient) allowedArguments(ctx context.Context) (map[string]allowedArguments, error) {
+	data := struct {
+		Response struct {
+			ArgumentsList map[string]allowedArguments `json:"argumentslist"`
+		} `json:"response"`
+	}{}
+
+	err := c.post(ctx, "server/allowedarguments", &data, nil)
+	return data.Response.ArgumentsList, err
+}
+
+// validateTemplate checks the template against what GleSYS allows for server/create.
+func (c *apiClient) validateTemplate(ctx context.Context, t NodeTemplate) error {
+	if t.Platform != PlatformKVM && t.Platform != PlatformVMware {
+		return fmt.Errorf("%w: unsupported platform %q", ErrorInvalidNodeTemplate, t.Platform)
+	}
+	if t.DataCenter == "" || t.Template == "" {
+		return fmt.Errorf("%w: datacenter and template are required", ErrorInvalidNodeTemplate)
+	}
+
+	arguments, err := c.allowedArguments(ctx)
+	if err != nil {
+		return err
+	}
+
+	allowed, ok := arguments[t.Platform]
+	if !ok {
+		return fmt.Errorf("%w: platform %q is not available", ErrorInvalidNodeTemplate, t.Platform)
+	}
+
+	checks := []struct {
+		name   string
+		values allowedValues
+		value  string
+	}{
+		{"datacenter", allowed.DataCenter, t.DataCenter},
+		{"cpu cores", allowed.CPU, strconv.Itoa(t.CPU)},
+		{"memory", allowed.Memory, strconv.Itoa(t.Memory)},
+		{"storage", allowed.Storage, strconv.Itoa(t.Storage)},
+		{"bandwidth", allowed.Bandwidth, strconv.Itoa(t.Bandwidth)},
+		{"template", allowed.Template, t.Template},
+	}
+
+	for _, check := range checks {
+		if !check.values.allows(t.DataCenter, check.value) {
+			return fmt.Errorf("%w: %s %q is not allowed on %s in %s", ErrorInvalidNodeTemplate, check.name, check.value, t.Platform, t.DataCenter)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,170 @@
+package glesys
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	ertia "github.com/ertia-io/config/pkg/entities"
+)
+
+// fakeAPI answers GleSYS API requests with canned responses keyed by path
+// and records the parameters posted to each path. Responses starting with
+// "error:" fail with the rest as status text.
+type fakeAPI struct {
+	responses map[string]string
+	posted    map[string][]map[string]interface{}
+}
+
+func newFakeAPI(responses map[string]string) *fakeAPI {
+	return &fakeAPI{responses: responses, posted: map[string][]map[string]interface{}{}}
+}
+
+func (f *fakeAPI) client(t *testing.T) *apiClient {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimPrefix(r.URL.Path, "/")
+
+		body, _ := ioutil.ReadAll(r.Body)
+		params := map[string]interface{}{}
+		json.Unmarshal(body, &params)
+		f.posted[path] = append(f.posted[path], params)
+
+		response, ok := f.responses[path]
+		if !ok {
+			t.Errorf("unexpected request %s", path)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if strings.HasPrefix(response, "error:") {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{"response": map[string]interface{}{
+				"status": map[string]string{"text": strings.TrimPrefix(response, "error:")},
+			}})
+			return
+		}
+		w.Write([]byte(response))
+	}))
+	t.Cleanup(srv.Close)
+
+	c := newAPIClient("cl12345", "api-key")
+	c.baseURL = srv.URL + "/"
+	return c
+}
+
+const allowedArgumentsResponse = `{"response": {"argumentslist": {"KVM": {
+	"datacenter": ["Falkenberg", "Stockholm"],
+	"cpucores": [1, 2, 8],
+	"memorysize": {"Falkenberg": [1024, 12288], "Stockholm": [1024]},
+	"disksize": [20, 150],
+	"transfer": [100],
+	"template": [{"name": "debian-11"}, {"name": "ubuntu-20-04"}]
+}}}}`
+
+func TestValidateTemplate(t *testing.T) {
+	cases := []struct {
+		name     string
+		template func(t *NodeTemplate)
+
+		// invalid is expected in the ErrorInvalidNodeTemplate error, none
+		// when empty.
+		invalid string
+	}{
+		{
+			name:     "default",
+			template: func(t *NodeTemplate) {},
+		},
+		{
+			name:     "unsupported platform",
+			template: func(t *NodeTemplate) { t.Platform = "OpenVZ" },
+			invalid:  `unsupported platform "OpenVZ"`,
+		},
+		{
+			name:     "platform not offered",
+			template: func(t *NodeTemplate) { t.Platform = PlatformVMware },
+			invalid:  `platform "VMware" is not available`,
+		},
+		{
+			name:     "no datacenter",
+			template: func(t *NodeTemplate) { t.DataCenter = "" },
+			invalid:  "datacenter and template are required",
+		},
+		{
+			name:     "cpu not allowed",
+			template: func(t *NodeTemplate) { t.CPU = 3 },
+			invalid:  `cpu cores "3" is not allowed`,
+		},
+		{
+			name:     "memory allowed in another datacenter only",
+			template: func(t *NodeTemplate) { t.DataCenter = "Stockholm" },
+			invalid:  `memory "12288" is not allowed on KVM in Stockholm`,
+		},
+		{
+			name:     "unknown os template",
+			template: func(t *NodeTemplate) { t.Template = "centos-7" },
+			invalid:  `template "centos-7" is not allowed`,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			api := newFakeAPI(map[string]string{"server/allowedarguments": allowedArgumentsResponse})
+
+			template := DefaultNodeTemplate
+			tc.template(&template)
+
+			err := api.client(t).validateTemplate(context.Background(), template)
+
+			if tc.invalid == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrorInvalidNodeTemplate) || !strings.Contains(err.Error(), tc.invalid) {
+				t.Fatalf("got error %v, want %s", err, tc.invalid)
+			}
+		})
+	}
+}
+
+func TestTemplateFor(t *testing.T) {
+	p := NewNodeProvider(&ertia.Project{},
+		WithDefaultTemplate(NodeTemplate{Template: "default"}),
+		WithTemplate(MasterTemplate, NodeTemplate{Template: "master"}),
+		WithTemplate("large", NodeTemplate{Template: "large"}),
+	)
+
+	cases := []struct {
+		name string
+		node ertia.Node
+		want string
+	}{
+		{name: "agent falls back to default", node: ertia.Node{}, want: "default"},
+		{name: "master", node: ertia.Node{IsMaster: true}, want: "master"},
+		{name: "tag before role", node: ertia.Node{IsMaster: true, Tags: []string{"large"}}, want: "large"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := p.templateFor(&tc.node).Template; got != tc.want {
+				t.Errorf("got template %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestDefaultGlesysNode(t *testing.T) {
+	saved := DefaultGlesysNode
+	defer func() { DefaultGlesysNode = saved }()
+
+	DefaultGlesysNode.CPU = 2
+
+	if got := NewNodeProvider(&ertia.Project{}).DefaultTemplate; got.CPU != 2 || got.Template != DefaultNodeTemplate.Template {
+		t.Errorf("default template %+v does not follow DefaultGlesysNode", got)
+	}
+}
@@ -9,6 +9,8 @@ require (
 	github.com/hetznercloud/hcloud-go v1.33.1
 	github.com/rs/zerolog v1.26.1
 	github.com/segmentio/ksuid v1.0.4
+	golang.org/x/crypto v0.0.0-20220213190939-1e6e3497d506
+	gopkg.in/yaml.v2 v2.4.0
 	k8s.io/apimachinery v0.23.3
 )
 
@@ -29,7 +31,6 @@ require (
 	github.com/prometheus/common v0.26.0 // indirect
 	github.com/prometheus/procfs v0.6.0 // indirect
 	github.com/teris-io/shortid v0.0.0-20201117134242-e59966efd125 // indirect
-	golang.org/x/crypto v0.0.0-20220213190939-1e6e3497d506 // indirect
 	golang.org/x/sys v0.0.0-20211031064116-611d5d643895 // indirect
 	google.golang.org/protobuf v1.27.1 // indirect
 )
@@ -0,0 +1,107 @@
+package providers
+
+import (
+	"context"
+
+	ertia "github.com/ertia-io/config/pkg/entities"
+	"github.com/ertia-io/providers/dependencies"
+	"github.com/ertia-io/providers/k3s"
+)
+
+// HelmChartInstaller is implemented by node providers that install Helm
+// charts, e.g. cert-manager or an ingress controller, into their clusters.
+type HelmChartInstaller interface {
+	K3SHelmCharts(cfg *ertia.Project) []k3s.HelmChart
+}
+
+// HelmChartDefinition installs the chart through the server that lists its
+// dependency, once k3s is ready there, and upgrades it whenever the chart
+// changes.
+func HelmChartDefinition(p NodeProvider, chart k3s.HelmChart) dependencies.Definition {
+	dependency := dependencies.HelmChartDependency(chart.Name).Name
+
+	return dependencies.Definition{
+		ID:         "helm-" + chart.Name,
+		Dependency: dependency,
+		Applies:    isMaster,
+		Requires:   []dependencies.Requirement{{ID: K3SServer, Scope: dependencies.SameNode}},
+		Install: func(ctx context.Context, cfg *ertia.Project, node *ertia.Node) (*ertia.Project, error) {
+			hash, err := chart.Hash()
+			if err != nil {
+				return cfg, err
+			}
+
+			opts := k3sInstallOptions(ctx, p, cfg, node)
+			err = k3s.InstallHelmChart(ctx, opts.Connector(), *node, chart, opts.Timeouts.Install)
+			if err != nil {
+				return cfg, notReady(err)
+			}
+
+			k3s.SetProjectHelmChart(cfg, chart.Name, hash)
+			return cfg, nil
+		},
+		Outdated: func(cfg *ertia.Project, node *ertia.Node) bool {
+			hash, err := chart.Hash()
+			return err != nil || k3s.ProjectHelmChart(cfg, chart.Name) != hash
+		},
+	}
+}
+
+// SecretDefinition creates or updates a secret through the server that lists
+// its dependency, with the data read from the project, once k3s is ready
+// there.
+func SecretDefinition(p NodeProvider, id, namespace, name string, data func(cfg *ertia.Project) map[string]string) dependencies.Definition {
+	return dependencies.Definition{
+		ID:         id,
+		Dependency: dependencies.SecretDependency(name).Name,
+		Applies:    isMaster,
+		Requires:   []dependencies.Requirement{{ID: K3SServer, Scope: dependencies.SameNode}},
+		Install: func(ctx context.Context, cfg *ertia.Project, node *ertia.Node) (*ertia.Project, error) {
+			err := k3s.ApplySecret(ctx, k3sInstallOptions(ctx, p, cfg, node).Connector(), *node, namespace, name, data(cfg))
+			if err != nil {
+				return cfg, notReady(err)
+			}
+			return cfg, nil
+		},
+	}
+}
+
+// helmCharts adds the dependencies of the charts of p to the first server
+// and returns their definitions.
+func helmCharts(p NodeProvider, cfg *ertia.Project) (*ertia.Project, []dependencies.Definition) {
+	installer, ok := p.(HelmChartInstaller)
+	if !ok {
+		return cfg, nil
+	}
+
+	var defs []dependencies.Definition
+	for _, chart := range installer.K3SHelmCharts(cfg) {
+		cfg = AddClusterDependency(cfg, dependencies.HelmChartDependency(chart.Name))
+		defs = append(defs, HelmChartDefinition(p, chart))
+	}
+	return cfg, defs
+}
+
+// AddClusterDependency adds a dependency that is installed once per cluster
+// to the first server, unless a node has it already.
+func AddClusterDependency(cfg *ertia.Project, dependency ertia.Dependency) *ertia.Project {
+	var first *ertia.Node
+	for i := range cfg.Nodes {
+		node := &cfg.Nodes[i]
+		for _, dep := range node.Dependencies {
+			if dep.Name == dependency.Name {
+				return cfg
+			}
+		}
+		if first == nil && node.IsMaster {
+			first = node
+		}
+	}
+
+	if first == nil {
+		return cfg
+	}
+
+	first.Dependencies = append(first.Dependencies, dependency)
+	return cfg.UpdateNode(first)
+}
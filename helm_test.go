@@ -0,0 +1,65 @@
+package providers
+
+import (
+	"context"
+	"testing"
+
+	ertia "github.com/ertia-io/config/pkg/entities"
+	"github.com/ertia-io/providers/dependencies"
+	"github.com/ertia-io/providers/k3s"
+	"github.com/ertia-io/providers/k3s/k3stest"
+)
+
+func TestHelmChartDefinitionAppliesChanges(t *testing.T) {
+	// Applies report the chart unchanged, so no new job is waited for.
+	f := k3stest.NewFakeExecutor()
+	f.Outputs["k3s kubectl apply"] = []byte("helmchart.helm.cattle.io/ingress unchanged")
+	f.Outputs["k3s kubectl 'get' 'job'"] = []byte("uid-1|1||")
+	p := fakeProvider{exec: f}
+
+	server := readyServer("a", "10.0.0.1")
+	server.Dependencies = append(server.Dependencies, dependencies.HelmChartDependency("ingress"))
+	cfg := &ertia.Project{Nodes: []ertia.Node{server}}
+
+	chart := k3s.HelmChart{Name: "ingress", Chart: "ingress-nginx", Values: map[string]interface{}{"replicas": 1}}
+
+	sync := func(chart k3s.HelmChart) bool {
+		t.Helper()
+
+		g, err := dependencies.NewGraph(
+			dependencies.Definition{ID: K3SServer, Dependency: dependencies.K3SDependency.Name, Install: installNothing},
+			HelmChartDefinition(p, chart),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		f.Commands = nil
+		cfg, err = g.Sync(context.Background(), cfg)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		hash, _ := chart.Hash()
+		if got := k3s.ProjectHelmChart(cfg, chart.Name); got != hash {
+			t.Errorf("recorded hash %s, want %s", got, hash)
+		}
+		return f.Ran("k3s kubectl apply")
+	}
+
+	if !sync(chart) {
+		t.Error("new chart not applied")
+	}
+	if sync(chart) {
+		t.Error("unchanged chart applied again")
+	}
+
+	chart.Values = map[string]interface{}{"replicas": 2}
+	if !sync(chart) {
+		t.Error("changed chart not applied")
+	}
+}
+
+func installNothing(ctx context.Context, cfg *ertia.Project, node *ertia.Node) (*ertia.Project, error) {
+	return cfg, nil
+}
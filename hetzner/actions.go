@@ -0,0 +1,90 @@
+package hetzner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	ertia "github.com/ertia-io/config/pkg/entities"
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"github.com/rs/zerolog/log"
+)
+
+// waitForActions blocks until every action has finished and returns the first
+// failure. Waiting is bounded by the provider ActionTimeout.
+func (p *HetznerNodeProvider) waitForActions(ctx context.Context, hc *hcloud.Client, actions ...*hcloud.Action) error {
+	watch := make([]*hcloud.Action, 0, len(actions))
+	for _, action := range actions {
+		if action != nil {
+			watch = append(watch, action)
+		}
+	}
+	if len(watch) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, p.ActionTimeout)
+	defer cancel()
+
+	progressCh, errCh := hc.Action.WatchOverallProgress(ctx, watch)
+	for {
+		select {
+		case progress, ok := <-progressCh:
+			if !ok {
+				progressCh = nil
+				continue
+			}
+			log.Ctx(ctx).Debug().Int("progress", progress).Msg("Waiting for Hetzner actions")
+		case err, ok := <-errCh:
+			if !ok {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+var (
+	ErrorServerStatusTimeout = errors.New("Hetzner.ServerStatusTimeout")
+)
+
+const serverStatusPollInterval = 2 * time.Second
+
+// waitForServerStatus polls the server until it reports the wanted status.
+func (p *HetznerNodeProvider) waitForServerStatus(ctx context.Context, hc *hcloud.Client, id int, status hcloud.ServerStatus, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+
+	for {
+		server, _, err := hc.Server.GetByID(ctx, id)
+		if err != nil {
+			return err
+		}
+		if server == nil {
+			return fmt.Errorf("server %d not found", id)
+		}
+		if server.Status == status {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%w: server %d is %s, expected %s", ErrorServerStatusTimeout, id, server.Status, status)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(serverStatusPollInterval):
+		}
+	}
+}
+
+// failNode records err on the node and marks it as failing.
+func failNode(ctx context.Context, cfg *ertia.Project, node *ertia.Node, err error) (*ertia.Project, error) {
+	log.Ctx(ctx).Error().Err(err).Str("node", node.Name).Send()
+	node.Status = ertia.NodeStatusFailing
+	node.Error = err.Error()
+	return cfg.UpdateNode(node), err
+}
@@ -0,0 +1,113 @@
+package hetzner
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+)
+
+// sequence returns the responses in turn, repeating the last one.
+func sequence(responses ...interface{}) func() interface{} {
+	return func() interface{} {
+		next := responses[0]
+		if len(responses) > 1 {
+			responses = responses[1:]
+		}
+		return next
+	}
+}
+
+func actions(status string) map[string]interface{} {
+	action := map[string]interface{}{"id": 1, "status": status, "command": "start_server"}
+	if status == "error" {
+		action["error"] = map[string]string{"code": "action_failed", "message": "Action failed"}
+	}
+	return map[string]interface{}{"actions": []interface{}{action}}
+}
+
+func TestWaitForActions(t *testing.T) {
+	cases := []struct {
+		name    string
+		polled  []interface{}
+		timeout time.Duration
+
+		failed   bool
+		timedOut bool
+	}{
+		{
+			name:    "success",
+			polled:  []interface{}{actions("running"), actions("success")},
+			timeout: time.Second,
+		},
+		{
+			name:    "error",
+			polled:  []interface{}{actions("running"), actions("error")},
+			timeout: time.Second,
+			failed:  true,
+		},
+		{
+			name:     "timeout",
+			polled:   []interface{}{actions("running")},
+			timeout:  50 * time.Millisecond,
+			timedOut: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			hc := fakeAPI{"GET /actions": sequence(tc.polled...)}.client(t)
+			p := NewNodeProvider(WithActionTimeout(tc.timeout))
+
+			err := p.waitForActions(context.Background(), hc, nil, &hcloud.Action{ID: 1})
+
+			switch {
+			case tc.timedOut:
+				if !errors.Is(err, context.DeadlineExceeded) {
+					t.Fatalf("got error %v, want deadline exceeded", err)
+				}
+			case tc.failed:
+				if err == nil {
+					t.Fatal("failed action not reported")
+				}
+			case err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestWaitForActionsWithoutActions(t *testing.T) {
+	err := NewNodeProvider().waitForActions(context.Background(), fakeAPI{}.client(t), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestWaitForServerStatus(t *testing.T) {
+	server := func(status string) map[string]interface{} {
+		return map[string]interface{}{"server": map[string]interface{}{"id": 1, "status": status}}
+	}
+
+	cases := []struct {
+		name   string
+		server interface{}
+		want   error
+	}{
+		{name: "reached", server: server("off")},
+		{name: "not reached", server: server("running"), want: ErrorServerStatusTimeout},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			hc := fakeAPI{"GET /servers/1": tc.server}.client(t)
+
+			err := NewNodeProvider().waitForServerStatus(context.Background(), hc, 1, hcloud.ServerStatusOff, 0)
+			if !errors.Is(err, tc.want) {
+				t.Fatalf("got error %v, want %v", err, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,23 @@
+package hetzner
+
+import (
+	ertia "github.com/ertia-io/config/pkg/entities"
+	"github.com/ertia-io/providers/redact"
+	"github.com/hetznercloud/hcloud-go/hcloud"
+)
+
+// newClient returns an API client for the project, keeping its token out of
+// the logs.
+func newClient(cfg *ertia.Project, opts ...hcloud.ClientOption) *hcloud.Client {
+	redact.Keep(cfg.ProviderToken)
+	return hcloud.NewClient(append([]hcloud.ClientOption{hcloud.WithToken(cfg.ProviderToken)}, opts...)...)
+}
+
+// client returns an API client for the project, talking to APIEndpoint when
+// it is set.
+func (p *HetznerNodeProvider) client(cfg *ertia.Project) *hcloud.Client {
+	if p.APIEndpoint == "" {
+		return newClient(cfg)
+	}
+	return newClient(cfg, hcloud.WithEndpoint(p.APIEndpoint))
+}
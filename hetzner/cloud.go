@@ -0,0 +1,86 @@
+package hetzner
+
+import (
+	"context"
+
+	ertia "github.com/ertia-io/config/pkg/entities"
+	"github.com/ertia-io/providers"
+	"github.com/ertia-io/providers/dependencies"
+	"github.com/ertia-io/providers/k3s"
+)
+
+const (
+	hcloudChartRepo = "https://charts.hetzner.cloud"
+
+	// hcloudSecret holds the API token, under the name and key both charts
+	// read it from.
+	hcloudSecret          = "hcloud"
+	hcloudSecretNamespace = "kube-system"
+	hcloudSecretID        = "hcloud-secret"
+)
+
+// DefaultCloudControllerManager lets LoadBalancer services create Hetzner
+// load balancers and initialises nodes with their Hetzner metadata.
+var DefaultCloudControllerManager = k3s.HelmChart{
+	Name:      "hcloud-cloud-controller-manager",
+	Repo:      hcloudChartRepo,
+	Chart:     "hcloud-cloud-controller-manager",
+	Namespace: "kube-system",
+}
+
+// DefaultCSIDriver provisions Hetzner volumes for PersistentVolumeClaims.
+var DefaultCSIDriver = k3s.HelmChart{
+	Name:      "hcloud-csi",
+	Repo:      hcloudChartRepo,
+	Chart:     "hcloud-csi",
+	Namespace: "kube-system",
+}
+
+// cloudConfig makes k3s leave nodes to the Hetzner cloud controller manager.
+func (p *HetznerNodeProvider) cloudConfig(node *ertia.Node) k3s.Config {
+	if p.CloudControllerManager == nil {
+		return k3s.Config{}
+	}
+
+	c := k3s.Config{KubeletArgs: []string{"cloud-provider=external"}}
+	if node.IsMaster {
+		c.Extra = map[string]interface{}{"disable-cloud-controller": true}
+	}
+	return c
+}
+
+// cloudDefinitions install the token secret, then the cloud controller
+// manager and then the CSI driver through the first server.
+func (p *HetznerNodeProvider) cloudDefinitions(cfg *ertia.Project) (*ertia.Project, []dependencies.Definition) {
+	if p.CloudControllerManager == nil {
+		return cfg, nil
+	}
+
+	secret := providers.SecretDefinition(p, hcloudSecretID, hcloudSecretNamespace, hcloudSecret, func(cfg *ertia.Project) map[string]string {
+		return map[string]string{"token": cfg.ProviderToken}
+	})
+	cfg = providers.AddClusterDependency(cfg, dependencies.SecretDependency(hcloudSecret))
+
+	ccm := providers.HelmChartDefinition(p, *p.CloudControllerManager)
+	ccm.Requires = append(ccm.Requires, dependencies.Requirement{ID: secret.ID, Scope: dependencies.SameNode})
+	ccm.Ready = p.cloudReady
+	cfg = providers.AddClusterDependency(cfg, dependencies.HelmChartDependency(p.CloudControllerManager.Name))
+
+	defs := []dependencies.Definition{secret, ccm}
+
+	if p.CSIDriver != nil {
+		csi := providers.HelmChartDefinition(p, *p.CSIDriver)
+		csi.Requires = append(csi.Requires, dependencies.Requirement{ID: ccm.ID, Scope: dependencies.SameNode})
+		cfg = providers.AddClusterDependency(cfg, dependencies.HelmChartDependency(p.CSIDriver.Name))
+		defs = append(defs, csi)
+	}
+
+	return cfg, defs
+}
+
+// cloudReady waits for the system pods k3s readiness skipped while the nodes
+// were waiting for the cloud controller manager.
+func (p *HetznerNodeProvider) cloudReady(ctx context.Context, cfg *ertia.Project, node *ertia.Node) error {
+	opts := p.K3SInstallOptions(ctx, cfg, node)
+	return k3s.WaitForReady(ctx, opts.Connector(), *node, node.Name, opts.Timeouts.Readiness)
+}
@@ -0,0 +1,107 @@
+package hetzner
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	ertia "github.com/ertia-io/config/pkg/entities"
+	"github.com/ertia-io/providers/dependencies"
+)
+
+func TestCloudConfig(t *testing.T) {
+	cases := []struct {
+		name string
+		opts []NodeProviderOption
+		node ertia.Node
+
+		external bool
+		kubelet  bool
+		disable  bool
+	}{
+		{name: "server", node: ertia.Node{IsMaster: true}, external: true, kubelet: true, disable: true},
+		{name: "agent", node: ertia.Node{}, external: true, kubelet: true},
+		{name: "server without integration", opts: []NodeProviderOption{WithoutCloudIntegration()}, node: ertia.Node{IsMaster: true}},
+		{name: "agent without integration", opts: []NodeProviderOption{WithoutCloudIntegration()}, node: ertia.Node{}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := NewNodeProvider(tc.opts...)
+			cfg := &ertia.Project{Nodes: []ertia.Node{tc.node}}
+
+			opts := p.K3SInstallOptions(context.Background(), cfg, &cfg.Nodes[0])
+			rendered, err := opts.Config.Render()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if opts.ExternalCloudProvider != tc.external {
+				t.Errorf("external cloud provider %v, want %v", opts.ExternalCloudProvider, tc.external)
+			}
+			if got := strings.Contains(string(rendered), "- cloud-provider=external"); got != tc.kubelet {
+				t.Errorf("config.yaml %q, want kubelet cloud provider %v", rendered, tc.kubelet)
+			}
+			if got := strings.Contains(string(rendered), "disable-cloud-controller: true"); got != tc.disable {
+				t.Errorf("config.yaml %q, want built-in cloud controller disabled %v", rendered, tc.disable)
+			}
+		})
+	}
+}
+
+func TestCloudDefinitions(t *testing.T) {
+	csi := DefaultCSIDriver
+
+	cases := []struct {
+		name string
+		opts []NodeProviderOption
+
+		// defs are the definition IDs, each requiring the one before.
+		defs []string
+	}{
+		{name: "default", defs: []string{hcloudSecretID, "helm-" + DefaultCloudControllerManager.Name, "helm-" + DefaultCSIDriver.Name}},
+		{name: "without csi", opts: []NodeProviderOption{func(p *HetznerNodeProvider) *HetznerNodeProvider {
+			p.CSIDriver = nil
+			return p
+		}}, defs: []string{hcloudSecretID, "helm-" + DefaultCloudControllerManager.Name}},
+		{name: "without integration", opts: []NodeProviderOption{WithCSIDriver(csi), WithoutCloudIntegration()}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := NewNodeProvider(tc.opts...)
+			cfg := &ertia.Project{Nodes: []ertia.Node{{ID: "agent"}, {ID: "server", IsMaster: true}, {ID: "other", IsMaster: true}}}
+
+			cfg, defs := p.cloudDefinitions(cfg)
+
+			if len(defs) != len(tc.defs) {
+				t.Fatalf("got %d definitions, want %v", len(defs), tc.defs)
+			}
+			for i, d := range defs {
+				if d.ID != tc.defs[i] {
+					t.Errorf("definition %d is %s, want %s", i, d.ID, tc.defs[i])
+				}
+				if i > 0 && !requires(d, tc.defs[i-1]) {
+					t.Errorf("%s does not require %s on the same node", d.ID, tc.defs[i-1])
+				}
+			}
+
+			// One of each on the first server.
+			if got := len(cfg.FindNodeByID("server").Dependencies); got != len(tc.defs) {
+				t.Errorf("first server has %d dependencies, want %d", got, len(tc.defs))
+			}
+			if len(cfg.FindNodeByID("agent").Dependencies)+len(cfg.FindNodeByID("other").Dependencies) > 0 {
+				t.Error("cloud dependencies added to other nodes")
+			}
+		})
+	}
+}
+
+func requires(d dependencies.Definition, id string) bool {
+	for _, r := range d.Requires {
+		if r.ID == id && r.Scope == dependencies.SameNode {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,120 @@
+package hetzner
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	"github.com/ertia-io/providers/redact"
+)
+
+const hetznerDNSURL = "https://dns.hetzner.com/api/v1"
+
+// dnsClient is a minimal client for the Hetzner DNS API, which is separate
+// from the Hetzner Cloud API and uses its own token.
+type dnsClient struct {
+	token   string
+	baseURL string
+	http    *http.Client
+}
+
+type dnsZone struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type dnsRecord struct {
+	ID     string `json:"id,omitempty"`
+	ZoneID string `json:"zone_id"`
+	Type   string `json:"type"`
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	TTL    int    `json:"ttl,omitempty"`
+}
+
+func newDNSClient(token string) *dnsClient {
+	redact.Keep(token)
+	return &dnsClient{
+		token:   token,
+		baseURL: hetznerDNSURL,
+		http:    http.DefaultClient,
+	}
+}
+
+func (c *dnsClient) do(ctx context.Context, method, path string, v interface{}, params interface{}) error {
+	buffer := new(bytes.Buffer)
+	if params != nil {
+		if err := json.NewEncoder(buffer).Encode(params); err != nil {
+			return err
+		}
+	}
+
+	request, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, buffer)
+	if err != nil {
+		return err
+	}
+
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Auth-API-Token", c.token)
+
+	response, err := c.http.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("hetzner dns: %s %s failed with HTTP error: %d (%s)", method, path, response.StatusCode, bytes.TrimSpace(body))
+	}
+
+	if v == nil {
+		return nil
+	}
+
+	return json.Unmarshal(body, v)
+}
+
+func (c *dnsClient) findZone(ctx context.Context, name string) (*dnsZone, error) {
+	data := struct {
+		Zones []dnsZone `json:"zones"`
+	}{}
+
+	err := c.do(ctx, http.MethodGet, "/zones?name="+url.QueryEscape(name), &data, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range data.Zones {
+		if data.Zones[i].Name == name {
+			return &data.Zones[i], nil
+		}
+	}
+
+	return nil, nil
+}
+
+func (c *dnsClient) listRecords(ctx context.Context, zoneID string) ([]dnsRecord, error) {
+	data := struct {
+		Records []dnsRecord `json:"records"`
+	}{}
+
+	err := c.do(ctx, http.MethodGet, "/records?zone_id="+url.QueryEscape(zoneID), &data, nil)
+	return data.Records, err
+}
+
+func (c *dnsClient) createRecord(ctx context.Context, record dnsRecord) error {
+	return c.do(ctx, http.MethodPost, "/records", nil, record)
+}
+
+func (c *dnsClient) updateRecord(ctx context.Context, record dnsRecord) error {
+	return c.do(ctx, http.MethodPut, "/records/"+url.PathEscape(record.ID), nil, record)
+}
@@ -2,19 +2,55 @@ package hetzner
 
 import (
 	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
 
 	ertia "github.com/ertia-io/config/pkg/entities"
-	"github.com/hetznercloud/hcloud-go/hcloud"
+)
+
+const (
+	halfHour = 1800
+	IPv4     = "A"
+
+	// DNSTokenEnv is read for the Hetzner DNS API token by
+	// WithDNSTokenFromEnv.
+	DNSTokenEnv = "HETZNER_DNS_API_TOKEN"
 )
 
 type DNSProvider struct {
-	Client *hcloud.Client
+	client *dnsClient
+}
+
+type DNSProviderOption func(p *DNSProvider) *DNSProvider
+
+// WithDNSToken sets the Hetzner DNS API token, which is not the same as the
+// Hetzner Cloud token in the project.
+func WithDNSToken(token string) DNSProviderOption {
+	return func(p *DNSProvider) *DNSProvider {
+		p.client = newDNSClient(token)
+		return p
+	}
+}
+
+// WithDNSTokenFromEnv reads the Hetzner DNS API token from the
+// HETZNER_DNS_API_TOKEN environment variable.
+func WithDNSTokenFromEnv() DNSProviderOption {
+	return WithDNSToken(os.Getenv(DNSTokenEnv))
 }
 
-func NewDNSProvider(cfg *ertia.Project) *DNSProvider {
-	return &DNSProvider{
-		Client: hcloud.NewClient(hcloud.WithToken(cfg.ProviderToken)),
+func NewDNSProvider(cfg *ertia.Project, opts ...DNSProviderOption) *DNSProvider {
+	p := &DNSProvider{
+		client: newDNSClient(""),
 	}
+
+	for _, opt := range opts {
+		p = opt(p)
+	}
+
+	return p
 }
 
 func (p *DNSProvider) Name() string {
@@ -22,5 +58,105 @@ func (p *DNSProvider) Name() string {
 }
 
 func (p *DNSProvider) CreateRecord(ctx context.Context, cfg *ertia.Project) (*ertia.Project, error) {
-	return cfg, nil
+	if !cfg.DNS.NeedsAdapting() {
+		return cfg, nil
+	}
+
+	if p.client.token == "" {
+		return cfg, fmt.Errorf("no Hetzner DNS API token, use WithDNSToken")
+	}
+
+	ip, err := getDomainIP(cfg)
+	if err != nil {
+		return cfg, err
+	}
+
+	dns := cfg.DNS
+	if dns == nil {
+		return cfg, fmt.Errorf("DNS configuration not found")
+	}
+
+	domainSufix := dns.Domain
+	if len(domainSufix) == 0 {
+		return cfg, fmt.Errorf("empty domain found")
+	}
+	host := fmt.Sprintf("*%s", domainSufix)
+
+	zone, err := p.findZone(ctx, host)
+	if err != nil {
+		return cfg, err
+	}
+
+	// Record names are relative to the zone.
+	name := strings.TrimSuffix(strings.TrimSuffix(host, "."+zone.Name), ".")
+
+	records, err := p.client.listRecords(ctx, zone.ID)
+	if err != nil {
+		return cfg, err
+	}
+
+	record := dnsRecord{
+		ZoneID: zone.ID,
+		Type:   IPv4,
+		Name:   name,
+		Value:  ip.String(),
+		TTL:    halfHour,
+	}
+
+	for _, r := range records {
+		if r.Name == name && r.Type == IPv4 {
+			record.ID = r.ID
+			break
+		}
+	}
+
+	if record.ID == "" {
+		err = p.client.createRecord(ctx, record)
+	} else {
+		err = p.client.updateRecord(ctx, record)
+	}
+	if err != nil {
+		return cfg, err
+	}
+
+	dns.Status = ertia.DNSStatusReady
+	dns.IPV4 = ip
+	dns.Updated = time.Now()
+
+	return cfg.UpdateDNS(dns), nil
+}
+
+// findZone finds the most specific zone on the account that the host belongs to.
+func (p *DNSProvider) findZone(ctx context.Context, host string) (*dnsZone, error) {
+	labels := strings.Split(strings.Trim(host, "."), ".")
+
+	// Never look up the bare top level domain.
+	for i := 1; i < len(labels)-1; i++ {
+		zone, err := p.client.findZone(ctx, strings.Join(labels[i:], "."))
+		if err != nil {
+			return nil, err
+		}
+		if zone != nil {
+			return zone, nil
+		}
+	}
+
+	return nil, fmt.Errorf("could not find a Hetzner DNS zone for: %s", host)
+}
+
+func getDomainIP(cfg *ertia.Project) (net.IP, error) {
+	node := cfg.FindNonMasterNode()
+	if node == nil {
+		return nil, fmt.Errorf("no non master node found")
+	}
+
+	if node.Status != ertia.NodeStatusActive {
+		return nil, fmt.Errorf("non master node: %s, is not active", node.Name)
+	}
+
+	if node.IPV4 == nil {
+		return nil, fmt.Errorf("no IPv4 found in node: %s", node.Name)
+	}
+
+	return node.IPV4, nil
 }
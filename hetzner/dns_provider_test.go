@@ -0,0 +1,133 @@
+package hetzner
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	ertia "github.com/ertia-io/config/pkg/entities"
+)
+
+// fakeDNS is a Hetzner DNS API holding the example.com zone.
+type fakeDNS struct {
+	records []dnsRecord
+
+	// written is the last record created or updated, by "METHOD /path".
+	written map[string]dnsRecord
+}
+
+func (f *fakeDNS) provider(t *testing.T) *DNSProvider {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Auth-API-Token") != "dns-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/zones":
+			zones := []dnsZone{}
+			if r.URL.Query().Get("name") == "example.com" {
+				zones = append(zones, dnsZone{ID: "zone-1", Name: "example.com"})
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"zones": zones})
+		case r.Method == http.MethodGet && r.URL.Path == "/records":
+			json.NewEncoder(w).Encode(map[string]interface{}{"records": f.records})
+		default:
+			var record dnsRecord
+			json.NewDecoder(r.Body).Decode(&record)
+			f.written[r.Method+" "+r.URL.Path] = record
+			w.Write([]byte("{}"))
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	p := NewDNSProvider(nil, WithDNSToken("dns-token"))
+	p.client.baseURL = srv.URL
+	return p
+}
+
+func TestCreateRecord(t *testing.T) {
+	cases := []struct {
+		name    string
+		records []dnsRecord
+		want    string
+	}{
+		{
+			name: "create",
+			want: "POST /records",
+		},
+		{
+			name: "update existing",
+			records: []dnsRecord{
+				{ID: "txt", Type: "TXT", Name: "*.apps"},
+				{ID: "a", Type: IPv4, Name: "*.apps", Value: "192.0.2.9"},
+			},
+			want: "PUT /records/a",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			dns := &fakeDNS{records: tc.records, written: map[string]dnsRecord{}}
+
+			cfg := &ertia.Project{
+				DNS: &ertia.DNS{Domain: ".apps.example.com"},
+				Nodes: []ertia.Node{
+					{Name: "master", IsMaster: true, IPV4: net.ParseIP("192.0.2.1")},
+					{Name: "agent", Status: ertia.NodeStatusActive, IPV4: net.ParseIP("192.0.2.2")},
+				},
+			}
+
+			cfg, err := dns.provider(t).CreateRecord(context.Background(), cfg)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			want := dnsRecord{ZoneID: "zone-1", Type: IPv4, Name: "*.apps", Value: "192.0.2.2", TTL: halfHour}
+			if tc.want != "POST /records" {
+				want.ID = "a"
+			}
+			if got, ok := dns.written[tc.want]; !ok || got != want || len(dns.written) != 1 {
+				t.Errorf("wrote %+v, want %s %+v", dns.written, tc.want, want)
+			}
+			if cfg.DNS.Status != ertia.DNSStatusReady || !cfg.DNS.IPV4.Equal(net.ParseIP("192.0.2.2")) {
+				t.Errorf("got DNS %+v, want it ready on the agent", cfg.DNS)
+			}
+		})
+	}
+}
+
+func TestCreateRecordWithoutZone(t *testing.T) {
+	dns := &fakeDNS{written: map[string]dnsRecord{}}
+
+	cfg := &ertia.Project{
+		DNS:   &ertia.DNS{Domain: ".apps.example.org"},
+		Nodes: []ertia.Node{{Name: "agent", Status: ertia.NodeStatusActive, IPV4: net.ParseIP("192.0.2.2")}},
+	}
+
+	_, err := dns.provider(t).CreateRecord(context.Background(), cfg)
+	if err == nil || len(dns.written) > 0 {
+		t.Fatalf("got error %v and records %v, want no zone found", err, dns.written)
+	}
+}
+
+func TestCreateRecordWithoutToken(t *testing.T) {
+	t.Setenv(DNSTokenEnv, "from-env")
+
+	p := NewDNSProvider(nil)
+	if p.client.token != "" {
+		t.Fatalf("token %q read without WithDNSTokenFromEnv", p.client.token)
+	}
+
+	_, err := p.CreateRecord(context.Background(), &ertia.Project{DNS: &ertia.DNS{Domain: ".example.com"}})
+	if err == nil {
+		t.Fatal("record created without a token")
+	}
+
+	if p := NewDNSProvider(nil, WithDNSTokenFromEnv()); p.client.token != "from-env" {
+		t.Errorf("token %q, want it read from %s", p.client.token, DNSTokenEnv)
+	}
+}
@@ -15,7 +15,7 @@ type HetznerKeyProvider struct {
 
 func NewKeyProvider(cfg *ertia.Project) *HetznerKeyProvider {
 	return &HetznerKeyProvider{
-		Client: hcloud.NewClient(hcloud.WithToken(cfg.ProviderToken)),
+		Client: newClient(cfg),
 	}
 }
 
@@ -78,9 +78,8 @@ func (p *HetznerKeyProvider) SyncKeys(ctx context.Context, cfg *ertia.Project) (
 	case ertia.KeyStatusNew:
 		cfg, err = p.CreateKey(ctx, cfg, cfg.SSHKey)
 		if err != nil {
-			panic("COuld not create key:" + err.Error())
-			//TODO Set key to failing and do NOT continue
-			log.Ctx(ctx).Err(err)
+			// CreateKey has already marked the key as failing.
+			log.Ctx(ctx).Err(err).Send()
 			return cfg, err
 		}
 	}
@@ -8,17 +8,243 @@ import (
 	"time"
 
 	ertia "github.com/ertia-io/config/pkg/entities"
+	"github.com/ertia-io/providers"
 	"github.com/ertia-io/providers/dependencies"
 	"github.com/ertia-io/providers/k3s"
 	"github.com/hetznercloud/hcloud-go/hcloud"
 	"github.com/rs/zerolog/log"
 )
 
+const (
+	DefaultActionTimeout       = 5 * time.Minute
+	DefaultShutdownGracePeriod = 2 * time.Minute
+)
+
 type HetznerNodeProvider struct {
+	DefaultSpec         NodeSpec
+	Specs               map[string]NodeSpec
+	ActionTimeout       time.Duration
+	ShutdownGracePeriod time.Duration
+	DrainTimeout        time.Duration
+
+	// APIEndpoint replaces the public Hetzner Cloud API endpoint.
+	APIEndpoint string
+
+	// ControlPlaneEndpoint is a stable address (DNS name, floating or load
+	// balancer IP) in front of the servers that agents and kubeconfigs use.
+	// It is the default for projects without a control-plane-endpoint: tag.
+	ControlPlaneEndpoint string
+
+	K3SVersion      string
+	K3SServerConfig k3s.Config
+	K3SAgentConfig  k3s.Config
+	K3SConfigs      map[string]k3s.Config
+
+	// K3SProgress receives the phases of every k3s install.
+	K3SProgress chan<- k3s.Progress
+
+	// K3SConnect opens the connection k3s is installed through, SSH when
+	// unset.
+	K3SConnect k3s.Connector
+
+	// KubeconfigMergeInto is a kubeconfig the project clusters are added to.
+	KubeconfigMergeInto string
+
+	// HelmCharts are installed into every cluster once k3s is ready.
+	HelmCharts []k3s.HelmChart
+
+	// CloudControllerManager and CSIDriver integrate the clusters with
+	// Hetzner Cloud, for LoadBalancer services and PersistentVolumeClaims.
+	// k3s runs with an external cloud provider while a cloud controller
+	// manager is set.
+	CloudControllerManager *k3s.HelmChart
+	CSIDriver              *k3s.HelmChart
+}
+
+type NodeProviderOption func(p *HetznerNodeProvider) *HetznerNodeProvider
+
+// WithDefaultSpec sets the spec used for nodes that match no other spec.
+func WithDefaultSpec(spec NodeSpec) NodeProviderOption {
+	return func(p *HetznerNodeProvider) *HetznerNodeProvider {
+		p.DefaultSpec = spec
+		return p
+	}
 }
 
-func NewNodeProvider() *HetznerNodeProvider {
-	return &HetznerNodeProvider{}
+// WithSpec registers a spec under a node tag or under MasterSpec/AgentSpec.
+func WithSpec(name string, spec NodeSpec) NodeProviderOption {
+	return func(p *HetznerNodeProvider) *HetznerNodeProvider {
+		p.Specs[name] = spec
+		return p
+	}
+}
+
+// WithActionTimeout bounds how long to wait for a Hetzner action to finish.
+func WithActionTimeout(timeout time.Duration) NodeProviderOption {
+	return func(p *HetznerNodeProvider) *HetznerNodeProvider {
+		p.ActionTimeout = timeout
+		return p
+	}
+}
+
+// WithShutdownGracePeriod sets how long StopNode waits for a graceful
+// shutdown before powering the server off.
+func WithShutdownGracePeriod(grace time.Duration) NodeProviderOption {
+	return func(p *HetznerNodeProvider) *HetznerNodeProvider {
+		p.ShutdownGracePeriod = grace
+		return p
+	}
+}
+
+// WithAPIEndpoint talks to the Hetzner Cloud API at endpoint, e.g. a proxy or
+// a fake API in tests.
+func WithAPIEndpoint(endpoint string) NodeProviderOption {
+	return func(p *HetznerNodeProvider) *HetznerNodeProvider {
+		p.APIEndpoint = endpoint
+		return p
+	}
+}
+
+// WithControlPlaneEndpoint makes the cluster highly available behind the
+// given endpoint. Servers are started with embedded etcd and the endpoint as
+// TLS SAN, and agents join through it. Projects override the endpoint with a
+// control-plane-endpoint: tag.
+func WithControlPlaneEndpoint(endpoint string) NodeProviderOption {
+	return func(p *HetznerNodeProvider) *HetznerNodeProvider {
+		p.ControlPlaneEndpoint = endpoint
+		return p
+	}
+}
+
+// WithK3SVersion pins the exact k3s release installed on new nodes.
+// Without it new nodes get the version already running in the cluster.
+func WithK3SVersion(version string) NodeProviderOption {
+	return func(p *HetznerNodeProvider) *HetznerNodeProvider {
+		p.K3SVersion = version
+		return p
+	}
+}
+
+// WithK3SProgress subscribes to the progress of k3s installs. Events are
+// dropped while the channel is full, so it should be buffered.
+func WithK3SProgress(progress chan<- k3s.Progress) NodeProviderOption {
+	return func(p *HetznerNodeProvider) *HetznerNodeProvider {
+		p.K3SProgress = progress
+		return p
+	}
+}
+
+// WithK3SConnector installs k3s through the connector instead of SSH, e.g.
+// a k3stest.FakeExecutor in tests.
+func WithK3SConnector(connect k3s.Connector) NodeProviderOption {
+	return func(p *HetznerNodeProvider) *HetznerNodeProvider {
+		p.K3SConnect = connect
+		return p
+	}
+}
+
+// WithKubeconfigMergeInto adds the cluster of every project to the
+// kubeconfig at path, e.g. ~/.kube/config, next to its own kubeconfig.
+func WithKubeconfigMergeInto(path string) NodeProviderOption {
+	return func(p *HetznerNodeProvider) *HetznerNodeProvider {
+		p.KubeconfigMergeInto = path
+		return p
+	}
+}
+
+// WithHelmChart installs the chart into every cluster and upgrades it when
+// it changes.
+func WithHelmChart(chart k3s.HelmChart) NodeProviderOption {
+	return func(p *HetznerNodeProvider) *HetznerNodeProvider {
+		p.HelmCharts = append(p.HelmCharts, chart)
+		return p
+	}
+}
+
+// WithCloudControllerManager replaces the default chart of the cloud
+// controller manager, e.g. to pin its version or set values.
+func WithCloudControllerManager(chart k3s.HelmChart) NodeProviderOption {
+	return func(p *HetznerNodeProvider) *HetznerNodeProvider {
+		p.CloudControllerManager = &chart
+		return p
+	}
+}
+
+// WithCSIDriver replaces the default chart of the CSI driver.
+func WithCSIDriver(chart k3s.HelmChart) NodeProviderOption {
+	return func(p *HetznerNodeProvider) *HetznerNodeProvider {
+		p.CSIDriver = &chart
+		return p
+	}
+}
+
+// WithoutCloudIntegration leaves out the cloud controller manager and CSI
+// driver, k3s then runs its own cloud controller.
+func WithoutCloudIntegration() NodeProviderOption {
+	return func(p *HetznerNodeProvider) *HetznerNodeProvider {
+		p.CloudControllerManager = nil
+		p.CSIDriver = nil
+		return p
+	}
+}
+
+// WithK3SServerConfig sets the default k3s config of server nodes, shared by
+// all projects. k3s-config: project and node tags are merged over it.
+func WithK3SServerConfig(c k3s.Config) NodeProviderOption {
+	return func(p *HetznerNodeProvider) *HetznerNodeProvider {
+		p.K3SServerConfig = c
+		return p
+	}
+}
+
+// WithK3SAgentConfig sets the default k3s config of agent nodes, shared by
+// all projects. k3s-config: project and node tags are merged over it.
+func WithK3SAgentConfig(c k3s.Config) NodeProviderOption {
+	return func(p *HetznerNodeProvider) *HetznerNodeProvider {
+		p.K3SAgentConfig = c
+		return p
+	}
+}
+
+// WithK3SConfig registers k3s config, e.g. node labels and taints, that is
+// merged into the config of nodes with the given tag.
+func WithK3SConfig(tag string, c k3s.Config) NodeProviderOption {
+	return func(p *HetznerNodeProvider) *HetznerNodeProvider {
+		p.K3SConfigs[tag] = c
+		return p
+	}
+}
+
+// WithDrain drains nodes from the cluster before they are stopped or deleted,
+// and removes deleted nodes from the cluster. Nodes that cannot be drained
+// within the timeout, e.g. because they are unreachable, are stopped or
+// deleted anyway. Disabled when timeout is zero.
+func WithDrain(timeout time.Duration) NodeProviderOption {
+	return func(p *HetznerNodeProvider) *HetznerNodeProvider {
+		p.DrainTimeout = timeout
+		return p
+	}
+}
+
+func NewNodeProvider(opts ...NodeProviderOption) *HetznerNodeProvider {
+	ccm, csi := DefaultCloudControllerManager, DefaultCSIDriver
+
+	p := &HetznerNodeProvider{
+		DefaultSpec:         DefaultHetznerNode,
+		Specs:               map[string]NodeSpec{},
+		K3SConfigs:          map[string]k3s.Config{},
+		ActionTimeout:       DefaultActionTimeout,
+		ShutdownGracePeriod: DefaultShutdownGracePeriod,
+
+		CloudControllerManager: &ccm,
+		CSIDriver:              &csi,
+	}
+
+	for _, opt := range opts {
+		p = opt(p)
+	}
+
+	return p
 }
 
 func (p *HetznerNodeProvider) Name() string {
@@ -26,8 +252,12 @@ func (p *HetznerNodeProvider) Name() string {
 }
 
 func (p *HetznerNodeProvider) CreateNode(ctx context.Context, cfg *ertia.Project, node *ertia.Node) (*ertia.Project, error) {
+	err := k3s.CheckUserTags(node.Tags)
+	if err != nil {
+		return failNode(ctx, cfg, node, err)
+	}
 
-	hc := hcloud.NewClient(hcloud.WithToken(cfg.ProviderToken))
+	hc := p.client(cfg)
 
 	sshKeys := []*hcloud.SSHKey{}
 
@@ -40,43 +270,60 @@ func (p *HetznerNodeProvider) CreateNode(ctx context.Context, cfg *ertia.Project
 		ID: intId,
 	})
 
+	spec, err := resolveSpec(ctx, hc, p.specFor(node))
+	if err != nil {
+		return failNode(ctx, cfg, node, err)
+	}
+
+	var networks []*hcloud.Network
+	if spec.Network != nil {
+		networks = append(networks, spec.Network)
+	}
+
 	//Create a kvm in hetzner.
-	result, _, err := hc.Server.Create(context.Background(), hcloud.ServerCreateOpts{
-		Name: node.Name,
-		ServerType: &hcloud.ServerType{
-			ID: 1, //TODO: COnfigurable. 3= CX21?
-		},
-		Image: &hcloud.Image{
-			Name: "ubuntu-20.04", //TODO Check ID?
-		},
+	result, _, err := hc.Server.Create(ctx, hcloud.ServerCreateOpts{
+		Name:             node.Name,
+		ServerType:       spec.ServerType,
+		Image:            spec.Image,
 		SSHKeys:          sshKeys,
-		Location:         nil, // TODO: Make this selectable
-		Datacenter:       nil, // TODO: Make this selectable
+		Location:         spec.Location,
+		Datacenter:       spec.Datacenter,
 		StartAfterCreate: boolAddr(true),
-		Labels:           nil, // TODO: Add tags to machine/cluster and apply these here..?
+		Labels:           spec.Labels,
 		Automount:        nil,
 		Volumes:          nil,
-		Networks:         nil,
+		Networks:         networks,
 		Firewalls:        nil,
 		PlacementGroup:   nil,
 	})
 
 	if err != nil {
-		log.Ctx(ctx).Error().Err(err).Send()
-		node.Status = ertia.NodeStatusFailing
-		node.Error = err.Error()
-		c := cfg.UpdateNode(node)
-		if err != nil {
-			log.Ctx(ctx).Error().Err(err).Send()
-		}
-		cfg = c
-		return c, err
+		return failNode(ctx, cfg, node, err)
 	}
 	node.ProviderID = fmt.Sprintf("%d", result.Server.ID)
 	node.IPV4 = result.Server.PublicNet.IPv4.IP
 	node.IPV6 = result.Server.PublicNet.IPv6.IP
-	node.Status = ertia.NodeStatusActive
+	node.Status = ertia.NodeStatusDeploying
 	node.InstallUser = "root"
+	cfg = cfg.UpdateNode(node)
+
+	err = p.waitForActions(ctx, hc, append([]*hcloud.Action{result.Action}, result.NextActions...)...)
+	if err != nil {
+		return failNode(ctx, cfg, node, err)
+	}
+
+	if spec.Network != nil {
+		server, _, err := hc.Server.GetByID(ctx, result.Server.ID)
+		if err != nil {
+			return failNode(ctx, cfg, node, err)
+		}
+		if server != nil && len(server.PrivateNet) > 0 {
+			k3s.SetNodePrivateIP(node, server.PrivateNet[0].IP)
+		}
+	}
+
+	node.Status = ertia.NodeStatusActive
+	node.Error = ""
 
 	//Deploy K3S Next
 	node.Dependencies = append(node.Dependencies, dependencies.K3SDependency)
@@ -85,8 +332,34 @@ func (p *HetznerNodeProvider) CreateNode(ctx context.Context, cfg *ertia.Project
 }
 
 func (p *HetznerNodeProvider) DeleteNode(ctx context.Context, cfg *ertia.Project, nodeId string) (*ertia.Project, error) {
+	node := cfg.FindNodeByID(nodeId)
 
-	hc := hcloud.NewClient(hcloud.WithToken(cfg.ProviderToken))
+	if p.DrainTimeout > 0 {
+		// Nodes are often deleted because they are dead, so one that
+		// cannot be drained is deleted all the same.
+		err := providers.DrainNode(ctx, p, cfg, node, p.DrainTimeout)
+		if err != nil {
+			log.Ctx(ctx).Warn().Err(err).Str("node", node.Name).Msg("Could not drain node, deleting it anyway")
+		}
+	}
+
+	cfg, err := p.DestroyServer(ctx, cfg, nodeId)
+	if err != nil {
+		return cfg, err
+	}
+
+	if p.DrainTimeout > 0 {
+		providers.RemoveClusterNode(ctx, p, cfg, node)
+	}
+	providers.RemoveKubeconfig(ctx, cfg, node, p.kubeconfigOptions(cfg))
+
+	return cfg, nil
+}
+
+// DestroyServer deletes the server of the node without draining it or
+// touching the cluster.
+func (p *HetznerNodeProvider) DestroyServer(ctx context.Context, cfg *ertia.Project, nodeId string) (*ertia.Project, error) {
+	hc := p.client(cfg)
 
 	node := cfg.FindNodeByID(nodeId)
 
@@ -95,6 +368,7 @@ func (p *HetznerNodeProvider) DeleteNode(ctx context.Context, cfg *ertia.Project
 		log.Ctx(ctx).Error().Err(err).Send()
 		return cfg, err
 	}
+
 	_, err = hc.Server.Delete(ctx, &hcloud.Server{ID: providerId})
 	if err != nil {
 		log.Ctx(ctx).Error().Err(err).Send()
@@ -106,7 +380,7 @@ func (p *HetznerNodeProvider) DeleteNode(ctx context.Context, cfg *ertia.Project
 }
 
 func (p *HetznerNodeProvider) RestartNode(ctx context.Context, cfg *ertia.Project, nodeId string) (*ertia.Project, error) {
-	hc := hcloud.NewClient(hcloud.WithToken(cfg.ProviderToken))
+	hc := p.client(cfg)
 
 	node := cfg.FindNodeByID(nodeId)
 	providerId, err := strconv.Atoi(node.ProviderID)
@@ -119,24 +393,23 @@ func (p *HetznerNodeProvider) RestartNode(ctx context.Context, cfg *ertia.Projec
 
 	node.Status = ertia.NodeStatusRestarting
 	cfg = cfg.UpdateNode(node)
+
+	action, _, err := hc.Server.Reboot(ctx, &hcloud.Server{ID: providerId})
 	if err != nil {
-		log.Ctx(ctx).Error().Err(err).Send()
-		return cfg, err
+		return failNode(ctx, cfg, node, err)
 	}
-	_, _, err = hc.Server.Reboot(ctx, &hcloud.Server{ID: providerId})
 
-	node.Status = originalStatus
-	cfg = cfg.UpdateNode(node)
+	err = p.waitForActions(ctx, hc, action)
 	if err != nil {
-		log.Ctx(ctx).Error().Err(err).Send()
-		return cfg, err
+		return failNode(ctx, cfg, node, err)
 	}
 
-	return cfg, nil
+	node.Status = originalStatus
+	return cfg.UpdateNode(node), nil
 }
 
 func (p *HetznerNodeProvider) StopNode(ctx context.Context, cfg *ertia.Project, nodeId string) (*ertia.Project, error) {
-	hc := hcloud.NewClient(hcloud.WithToken(cfg.ProviderToken))
+	hc := p.client(cfg)
 
 	node := cfg.FindNodeByID(nodeId)
 	providerId, err := strconv.Atoi(node.ProviderID)
@@ -145,25 +418,90 @@ func (p *HetznerNodeProvider) StopNode(ctx context.Context, cfg *ertia.Project,
 		return cfg, err
 	}
 
-	_, _, err = hc.Server.Shutdown(ctx, &hcloud.Server{ID: providerId})
+	if p.DrainTimeout > 0 {
+		err = providers.DrainNode(ctx, p, cfg, node, p.DrainTimeout)
+		if err != nil {
+			log.Ctx(ctx).Warn().Err(err).Str("node", node.Name).Msg("Could not drain node, stopping it anyway")
+		}
+	}
+
+	server := &hcloud.Server{ID: providerId}
+
+	// Ask the OS to shut down first and only pull the plug when it does not
+	// within the grace period.
+	action, _, err := hc.Server.Shutdown(ctx, server)
+	if err != nil {
+		return failNode(ctx, cfg, node, err)
+	}
+
+	err = p.waitForActions(ctx, hc, action)
+	if err != nil {
+		return failNode(ctx, cfg, node, err)
+	}
+
+	err = p.waitForServerStatus(ctx, hc, providerId, hcloud.ServerStatusOff, p.ShutdownGracePeriod)
+	if errors.Is(err, ErrorServerStatusTimeout) {
+		log.Ctx(ctx).Warn().Str("node", node.Name).Msg("Graceful shutdown timed out, powering off")
+
+		action, _, err = hc.Server.Poweroff(ctx, server)
+		if err != nil {
+			return failNode(ctx, cfg, node, err)
+		}
+
+		err = p.waitForActions(ctx, hc, action)
+		if err != nil {
+			return failNode(ctx, cfg, node, err)
+		}
+
+		err = p.waitForServerStatus(ctx, hc, providerId, hcloud.ServerStatusOff, p.ActionTimeout)
+	}
+	if err != nil {
+		return failNode(ctx, cfg, node, err)
+	}
 
 	node.Status = ertia.NodeStatusStopped
-	cfg = cfg.UpdateNode(node)
+	return cfg.UpdateNode(node), nil
+}
+
+func (p *HetznerNodeProvider) StartNode(ctx context.Context, cfg *ertia.Project, nodeId string) (*ertia.Project, error) {
+	hc := p.client(cfg)
+
+	node := cfg.FindNodeByID(nodeId)
+	providerId, err := strconv.Atoi(node.ProviderID)
 	if err != nil {
 		log.Ctx(ctx).Error().Err(err).Send()
 		return cfg, err
 	}
 
-	return cfg, nil
-}
+	action, _, err := hc.Server.Poweron(ctx, &hcloud.Server{ID: providerId})
+	if err != nil {
+		return failNode(ctx, cfg, node, err)
+	}
 
-func (p *HetznerNodeProvider) StartNode(ctx context.Context, cfg *ertia.Project, nodeId string) (*ertia.Project, error) {
-	return p.RestartNode(ctx, cfg, nodeId)
+	err = p.waitForActions(ctx, hc, action)
+	if err != nil {
+		return failNode(ctx, cfg, node, err)
+	}
+
+	err = p.waitForServerStatus(ctx, hc, providerId, hcloud.ServerStatusRunning, p.ActionTimeout)
+	if err != nil {
+		return failNode(ctx, cfg, node, err)
+	}
+
+	if p.DrainTimeout > 0 {
+		err = providers.UncordonNode(ctx, p, cfg, node)
+		if err != nil {
+			log.Ctx(ctx).Warn().Err(err).Str("node", node.Name).Msg("Could not uncordon node")
+		}
+	}
+
+	node.Status = ertia.NodeStatusActive
+	node.Error = ""
+	return cfg.UpdateNode(node), nil
 }
 
 func (p *HetznerNodeProvider) ReplaceNode(ctx context.Context, cfg *ertia.Project, nodeId string) (*ertia.Project, error) {
-	node := cfg.FindNodeByID(nodeId)
-	return p.CreateNode(ctx, cfg, node)
+	return providers.ReplaceNode(ctx, p, cfg, nodeId)
 }
 
 func (p *HetznerNodeProvider) SyncNodes(ctx context.Context, cfg *ertia.Project) (*ertia.Project, error) {
@@ -184,104 +522,41 @@ func (p *HetznerNodeProvider) SyncNodes(ctx context.Context, cfg *ertia.Project)
 }
 
 func (p *HetznerNodeProvider) SyncDependencies(ctx context.Context, cfg *ertia.Project) (*ertia.Project, error) {
-
-	var err error
-
-	for {
-		allDone := true
-		for i := range cfg.Nodes {
-			if cfg.Nodes[i].Requires(dependencies.K3SDependency.Name) {
-				fmt.Printf("Node %s requires %s \n", cfg.Nodes[i].Name, dependencies.K3SDependency.Name)
-				allDone = false
-				if cfg.Nodes[i].IsMaster {
-					cfg, err = installK3SMaster(ctx, cfg, &cfg.Nodes[i])
-					if err != nil {
-						if errors.Is(err, k3s.ErrorSSHNotReady) {
-							err = nil
-							time.Sleep(1 * time.Second)
-							break
-						}
-						return cfg, err
-					}
-				} else {
-					if cfg.Nodes[i].MasterIP != nil && cfg.Nodes[i].NodeToken != "" {
-						err := k3s.InstallK3SAgent(ctx, cfg.Nodes[i], cfg.Nodes[i].MasterIP.String(), cfg.K3SChannel)
-						if err != nil {
-							if errors.Is(err, k3s.ErrorSSHNotReady) {
-								err = nil
-								time.Sleep(1 * time.Second)
-								break
-							}
-							return cfg, err
-						}
-
-						for di := range cfg.Nodes[i].Dependencies {
-							if cfg.Nodes[i].Dependencies[di].Name == dependencies.K3SDependency.Name {
-								cfg.Nodes[i].Dependencies[di].Status = ertia.DependencyStatusReady
-							}
-						}
-
-						cfg = cfg.UpdateNode(&cfg.Nodes[i])
-						if err != nil {
-							return cfg, err
-						}
-
-					} else {
-						masterNode := cfg.FindMasterNode()
-						if masterNode.Fulfils(dependencies.K3SDependency.Name) {
-							cfg.Nodes[i].MasterIP = masterNode.IPV4
-							cfg.Nodes[i].NodeToken = masterNode.NodeToken
-							err := k3s.InstallK3SAgent(ctx, cfg.Nodes[i], masterNode.IPV4.String(), cfg.K3SChannel)
-							if err != nil {
-								if errors.Is(err, k3s.ErrorSSHNotReady) {
-									err = nil
-									time.Sleep(1 * time.Second)
-									break
-								}
-								return cfg, err
-							}
-
-							for di := range cfg.Nodes[i].Dependencies {
-								if cfg.Nodes[i].Dependencies[di].Name == dependencies.K3SDependency.Name {
-									cfg.Nodes[i].Dependencies[di].Status = ertia.DependencyStatusReady
-								}
-							}
-
-							cfg = cfg.UpdateNode(&cfg.Nodes[i])
-
-						} else {
-							//TODO: Maybe keep track of dependency status?
-						}
-					}
-
-				}
-			}
-		}
-		if allDone {
-			fmt.Println("All dependencies handled")
-			break
-		}
-	}
-
-	return cfg, nil
+	cfg, cloud := p.cloudDefinitions(cfg)
+	return providers.SyncDependencies(ctx, p, cfg, cloud...)
 }
 
-func boolAddr(b bool) *bool {
-	return &b
+// K3SHelmCharts returns the charts installed into the cluster.
+func (p *HetznerNodeProvider) K3SHelmCharts(cfg *ertia.Project) []k3s.HelmChart {
+	return p.HelmCharts
 }
 
-func installK3SMaster(ctx context.Context, cfg *ertia.Project, node *ertia.Node) (*ertia.Project, error) {
-	nodeToken, err := k3s.InstallK3SServer(ctx, node.IPV4, node.InstallUser, node.InstallPassword, cfg.K3SChannel)
-	if err != nil {
-		return cfg, err
+// K3SInstallOptions returns how k3s is installed on the node.
+func (p *HetznerNodeProvider) K3SInstallOptions(ctx context.Context, cfg *ertia.Project, node *ertia.Node) k3s.InstallOptions {
+	version := p.K3SVersion
+	if version == "" {
+		version = k3s.ClusterVersion(cfg)
 	}
 
-	for di := range node.Dependencies {
-		if node.Dependencies[di].Name == dependencies.K3SDependency.Name {
-			node.Dependencies[di].Status = ertia.DependencyStatusReady
-		}
+	return k3s.InstallOptions{
+		Channel:    cfg.K3SChannel,
+		Version:    version,
+		Endpoint:   k3s.EndpointFor(cfg, p.ControlPlaneEndpoint),
+		Config:     k3s.ConfigFor(ctx, cfg, node, p.K3SServerConfig, p.K3SAgentConfig, p.K3SConfigs).Merge(p.cloudConfig(node)),
+		SSH:        k3s.SSHConfigFor(cfg),
+		Connect:    p.K3SConnect,
+		Progress:   p.K3SProgress,
+		Timeouts:   k3s.TimeoutsFor(ctx, cfg),
+		Kubeconfig: p.kubeconfigOptions(cfg),
+
+		ExternalCloudProvider: p.CloudControllerManager != nil,
 	}
+}
 
-	node.NodeToken = nodeToken
-	return cfg.UpdateNode(node), nil
+func (p *HetznerNodeProvider) kubeconfigOptions(cfg *ertia.Project) k3s.KubeconfigOptions {
+	return k3s.KubeconfigOptions{Name: cfg.Name, ID: cfg.ID, MergeInto: p.KubeconfigMergeInto}
+}
+
+func boolAddr(b bool) *bool {
+	return &b
 }
@@ -0,0 +1,140 @@
+package hetzner
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	ertia "github.com/ertia-io/config/pkg/entities"
+	"github.com/ertia-io/providers/dependencies"
+	"github.com/ertia-io/providers/k3s/k3stest"
+)
+
+func serverStatus(status string) map[string]interface{} {
+	return map[string]interface{}{"server": map[string]interface{}{"id": 1, "status": status}}
+}
+
+func TestStopNode(t *testing.T) {
+	cases := []struct {
+		name   string
+		status []interface{}
+
+		// poweroff is whether the server is expected to be powered off
+		// after the graceful shutdown.
+		poweroff bool
+	}{
+		{
+			name:   "graceful",
+			status: []interface{}{serverStatus("off")},
+		},
+		{
+			name:     "power off after the grace period",
+			status:   []interface{}{serverStatus("running"), serverStatus("off")},
+			poweroff: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			poweredOff := false
+			api := fakeAPI{
+				"POST /servers/1/actions/shutdown": map[string]interface{}{"action": map[string]interface{}{"id": 1, "status": "running"}},
+				"POST /servers/1/actions/poweroff": func() interface{} {
+					poweredOff = true
+					return map[string]interface{}{"action": map[string]interface{}{"id": 2, "status": "running"}}
+				},
+				"GET /actions":   map[string]interface{}{"actions": []interface{}{map[string]interface{}{"id": 1, "status": "success"}, map[string]interface{}{"id": 2, "status": "success"}}},
+				"GET /servers/1": sequence(tc.status...),
+			}
+			p := NewNodeProvider(WithAPIEndpoint(api.url(t)), WithShutdownGracePeriod(0))
+
+			cfg := &ertia.Project{Nodes: []ertia.Node{{ID: "node", ProviderID: "1", Status: ertia.NodeStatusActive}}}
+			cfg, err := p.StopNode(context.Background(), cfg, "node")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if status := cfg.FindNodeByID("node").Status; status != ertia.NodeStatusStopped {
+				t.Errorf("node status %s, want %s", status, ertia.NodeStatusStopped)
+			}
+			if poweredOff != tc.poweroff {
+				t.Errorf("powered off %v, want %v", poweredOff, tc.poweroff)
+			}
+		})
+	}
+}
+
+func TestStartNode(t *testing.T) {
+	api := fakeAPI{
+		"POST /servers/1/actions/poweron": map[string]interface{}{"action": map[string]interface{}{"id": 1, "status": "running"}},
+		"GET /actions":                    map[string]interface{}{"actions": []interface{}{map[string]interface{}{"id": 1, "status": "success"}}},
+		"GET /servers/1":                  serverStatus("running"),
+	}
+	p := NewNodeProvider(WithAPIEndpoint(api.url(t)))
+
+	cfg := &ertia.Project{Nodes: []ertia.Node{{ID: "node", ProviderID: "1", Status: ertia.NodeStatusStopped, Error: "stopped"}}}
+	cfg, err := p.StartNode(context.Background(), cfg, "node")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if node := cfg.FindNodeByID("node"); node.Status != ertia.NodeStatusActive || node.Error != "" {
+		t.Errorf("got node %s (%s), want it active", node.Status, node.Error)
+	}
+}
+
+func TestDeleteNodeWhenDrainFails(t *testing.T) {
+	t.Setenv("ERTIAKUBE", t.TempDir())
+
+	deleted := false
+	api := fakeAPI{
+		"DELETE /servers/2": func() interface{} {
+			deleted = true
+			return map[string]interface{}{}
+		},
+	}
+
+	unreachable := k3stest.NewFakeExecutor()
+	unreachable.ConnectErr = errors.New("unreachable")
+
+	p := NewNodeProvider(WithAPIEndpoint(api.url(t)), WithDrain(time.Minute), WithK3SConnector(unreachable.Connect))
+
+	k3sReady := []ertia.Dependency{{Name: dependencies.K3SDependency.Name, Status: ertia.DependencyStatusReady}}
+	cfg := &ertia.Project{Name: "project", Nodes: []ertia.Node{
+		{ID: "server", ProviderID: "1", IsMaster: true, Dependencies: k3sReady},
+		{ID: "agent", ProviderID: "2", Dependencies: k3sReady},
+	}}
+
+	cfg, err := p.DeleteNode(context.Background(), cfg, "agent")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !deleted || cfg.FindNodeByID("agent").Status != ertia.NodeStatusDeleted {
+		t.Errorf("node not deleted after failing to drain it")
+	}
+}
+
+func TestK3SInstallOptionsEndpoint(t *testing.T) {
+	p := NewNodeProvider(WithControlPlaneEndpoint("default.example.com"))
+
+	cases := []struct {
+		name string
+		tags []string
+		want string
+	}{
+		{name: "provider default", want: "default.example.com"},
+		{name: "project tag", tags: []string{"control-plane-endpoint:k8s.example.com"}, want: "k8s.example.com"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &ertia.Project{Tags: tc.tags, Nodes: []ertia.Node{{ID: "server", IsMaster: true}}}
+
+			opts := p.K3SInstallOptions(context.Background(), cfg, cfg.FindNodeByID("server"))
+			if opts.Endpoint != tc.want {
+				t.Errorf("endpoint %q, want %q", opts.Endpoint, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,169 @@
+package hetzner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	ertia "github.com/ertia-io/config/pkg/entities"
+	"github.com/hetznercloud/hcloud-go/hcloud"
+)
+
+var (
+	ErrorInvalidNodeSpec = errors.New("Hetzner.InvalidNodeSpec")
+)
+
+const (
+	MasterSpec = "master"
+	AgentSpec  = "agent"
+)
+
+// NodeSpec describes the server a node is created on. All values are names as
+// used by the Hetzner API (e.g. cx21, ubuntu-20.04, fsn1, fsn1-dc14).
+type NodeSpec struct {
+	ServerType string
+	Image      string
+	Location   string
+	Datacenter string
+	Labels     map[string]string
+
+	// Network is the name or ID of a private network the server is
+	// attached to. Nodes behind an ssh-bastion are reached at their
+	// address in it.
+	Network string
+}
+
+var DefaultHetznerNode = NodeSpec{
+	ServerType: "cx11",
+	Image:      "ubuntu-20.04",
+}
+
+// specFor picks the spec for a node. Node tags are matched against the
+// configured specs first, so a tag can be used to place a node in a pool,
+// then the node role (MasterSpec/AgentSpec), then the default.
+func (p *HetznerNodeProvider) specFor(node *ertia.Node) NodeSpec {
+	for _, tag := range node.Tags {
+		if spec, ok := p.Specs[tag]; ok {
+			return spec
+		}
+	}
+
+	role := AgentSpec
+	if node.IsMaster {
+		role = MasterSpec
+	}
+	if spec, ok := p.Specs[role]; ok {
+		return spec
+	}
+
+	return p.DefaultSpec
+}
+
+type resolvedSpec struct {
+	ServerType *hcloud.ServerType
+	Image      *hcloud.Image
+	Location   *hcloud.Location
+	Datacenter *hcloud.Datacenter
+	Network    *hcloud.Network
+	Labels     map[string]string
+}
+
+// resolveSpec looks up every name in the spec against the Hetzner API and
+// makes sure the server type can actually be created where it is asked for.
+func resolveSpec(ctx context.Context, hc *hcloud.Client, spec NodeSpec) (*resolvedSpec, error) {
+	if spec.ServerType == "" {
+		return nil, fmt.Errorf("%w: no server type", ErrorInvalidNodeSpec)
+	}
+	if spec.Image == "" {
+		return nil, fmt.Errorf("%w: no image", ErrorInvalidNodeSpec)
+	}
+
+	resolved := &resolvedSpec{
+		Labels: spec.Labels,
+	}
+
+	serverType, _, err := hc.ServerType.GetByName(ctx, spec.ServerType)
+	if err != nil {
+		return nil, err
+	}
+	if serverType == nil {
+		return nil, fmt.Errorf("%w: unknown server type %q", ErrorInvalidNodeSpec, spec.ServerType)
+	}
+	resolved.ServerType = serverType
+
+	image, _, err := hc.Image.GetByName(ctx, spec.Image)
+	if err != nil {
+		return nil, err
+	}
+	if image == nil {
+		return nil, fmt.Errorf("%w: unknown image %q", ErrorInvalidNodeSpec, spec.Image)
+	}
+	if image.IsDeprecated() {
+		return nil, fmt.Errorf("%w: image %q is deprecated", ErrorInvalidNodeSpec, spec.Image)
+	}
+	resolved.Image = image
+
+	if spec.Location != "" {
+		location, _, err := hc.Location.GetByName(ctx, spec.Location)
+		if err != nil {
+			return nil, err
+		}
+		if location == nil {
+			return nil, fmt.Errorf("%w: unknown location %q", ErrorInvalidNodeSpec, spec.Location)
+		}
+		if !offeredIn(serverType, location) {
+			return nil, fmt.Errorf("%w: server type %q is not offered in location %q", ErrorInvalidNodeSpec, spec.ServerType, spec.Location)
+		}
+		resolved.Location = location
+	}
+
+	if spec.Datacenter != "" {
+		datacenter, _, err := hc.Datacenter.GetByName(ctx, spec.Datacenter)
+		if err != nil {
+			return nil, err
+		}
+		if datacenter == nil {
+			return nil, fmt.Errorf("%w: unknown datacenter %q", ErrorInvalidNodeSpec, spec.Datacenter)
+		}
+		if resolved.Location != nil && datacenter.Location != nil && datacenter.Location.ID != resolved.Location.ID {
+			return nil, fmt.Errorf("%w: datacenter %q is not in location %q", ErrorInvalidNodeSpec, spec.Datacenter, spec.Location)
+		}
+		if !availableIn(serverType, datacenter) {
+			return nil, fmt.Errorf("%w: server type %q is not available in datacenter %q", ErrorInvalidNodeSpec, spec.ServerType, spec.Datacenter)
+		}
+		// Location and datacenter are mutually exclusive when creating a server.
+		resolved.Location = nil
+		resolved.Datacenter = datacenter
+	}
+
+	if spec.Network != "" {
+		network, _, err := hc.Network.Get(ctx, spec.Network)
+		if err != nil {
+			return nil, err
+		}
+		if network == nil {
+			return nil, fmt.Errorf("%w: unknown network %q", ErrorInvalidNodeSpec, spec.Network)
+		}
+		resolved.Network = network
+	}
+
+	return resolved, nil
+}
+
+func offeredIn(serverType *hcloud.ServerType, location *hcloud.Location) bool {
+	for _, pricing := range serverType.Pricings {
+		if pricing.Location != nil && pricing.Location.Name == location.Name {
+			return true
+		}
+	}
+	return false
+}
+
+func availableIn(serverType *hcloud.ServerType, datacenter *hcloud.Datacenter) bool {
+	for _, available := range datacenter.ServerTypes.Available {
+		if available.ID == serverType.ID {
+			return true
+		}
+	}
+	return false
+}
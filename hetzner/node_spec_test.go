@@ -0,0 +1,216 @@
+package hetzner
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	ertia "github.com/ertia-io/config/pkg/entities"
+	"github.com/hetznercloud/hcloud-go/hcloud"
+)
+
+// fakeAPI answers Hetzner API requests from canned responses keyed by
+// "METHOD /path" and, for lookups by name, "METHOD /path?name".
+type fakeAPI map[string]interface{}
+
+func (f fakeAPI) client(t *testing.T) *hcloud.Client {
+	return hcloud.NewClient(hcloud.WithEndpoint(f.url(t)), hcloud.WithPollInterval(time.Millisecond))
+}
+
+// url starts the fake API and returns its endpoint.
+func (f fakeAPI) url(t *testing.T) string {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Method + " " + r.URL.Path
+		if name := r.URL.Query().Get("name"); name != "" {
+			key += "?" + name
+		}
+
+		body, ok := f[key]
+		if !ok {
+			t.Errorf("unexpected request %s", key)
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]interface{}{"error": map[string]string{"code": "not_found"}})
+			return
+		}
+		if next, ok := body.(func() interface{}); ok {
+			body = next()
+		}
+		json.NewEncoder(w).Encode(body)
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv.URL
+}
+
+func specAPI() fakeAPI {
+	cx21 := map[string]interface{}{
+		"id": 3, "name": "cx21",
+		"prices": []map[string]string{{"location": "fsn1"}, {"location": "nbg1"}},
+	}
+	fsn1 := map[string]interface{}{"id": 1, "name": "fsn1"}
+	nbg1 := map[string]interface{}{"id": 2, "name": "nbg1"}
+	hel1 := map[string]interface{}{"id": 3, "name": "hel1"}
+
+	return fakeAPI{
+		"GET /server_types?cx21":   map[string]interface{}{"server_types": []interface{}{cx21}},
+		"GET /server_types?cx99":   map[string]interface{}{"server_types": []interface{}{}},
+		"GET /images?ubuntu-20.04": map[string]interface{}{"images": []interface{}{map[string]interface{}{"id": 10, "name": "ubuntu-20.04"}}},
+		"GET /images?ubuntu-16.04": map[string]interface{}{"images": []interface{}{map[string]interface{}{"id": 11, "name": "ubuntu-16.04", "deprecated": "2021-01-01T00:00:00Z"}}},
+		"GET /locations?fsn1":      map[string]interface{}{"locations": []interface{}{fsn1}},
+		"GET /locations?nbg1":      map[string]interface{}{"locations": []interface{}{nbg1}},
+		"GET /locations?hel1":      map[string]interface{}{"locations": []interface{}{hel1}},
+		"GET /datacenters?fsn1-dc14": map[string]interface{}{"datacenters": []interface{}{map[string]interface{}{
+			"id": 4, "name": "fsn1-dc14", "location": fsn1,
+			"server_types": map[string][]int{"available": {3}},
+		}}},
+		"GET /datacenters?fsn1-dc8": map[string]interface{}{"datacenters": []interface{}{map[string]interface{}{
+			"id": 5, "name": "fsn1-dc8", "location": fsn1,
+			"server_types": map[string][]int{"available": {}},
+		}}},
+		"GET /networks?private": map[string]interface{}{"networks": []interface{}{map[string]interface{}{"id": 7, "name": "private"}}},
+		"GET /networks/7":       map[string]interface{}{"network": map[string]interface{}{"id": 7, "name": "private"}},
+	}
+}
+
+func TestResolveSpec(t *testing.T) {
+	cases := []struct {
+		name string
+		spec NodeSpec
+
+		// invalid is expected in the ErrorInvalidNodeSpec error, none when
+		// empty.
+		invalid    string
+		location   string
+		datacenter string
+		network    int
+	}{
+		{
+			name: "type and image",
+			spec: NodeSpec{ServerType: "cx21", Image: "ubuntu-20.04"},
+		},
+		{
+			name:     "location",
+			spec:     NodeSpec{ServerType: "cx21", Image: "ubuntu-20.04", Location: "fsn1"},
+			location: "fsn1",
+		},
+		{
+			name:       "datacenter replaces location",
+			spec:       NodeSpec{ServerType: "cx21", Image: "ubuntu-20.04", Location: "fsn1", Datacenter: "fsn1-dc14"},
+			datacenter: "fsn1-dc14",
+		},
+		{
+			name:    "network by name",
+			spec:    NodeSpec{ServerType: "cx21", Image: "ubuntu-20.04", Network: "private"},
+			network: 7,
+		},
+		{
+			name:    "network by id",
+			spec:    NodeSpec{ServerType: "cx21", Image: "ubuntu-20.04", Network: "7"},
+			network: 7,
+		},
+		{
+			name:    "no server type",
+			spec:    NodeSpec{Image: "ubuntu-20.04"},
+			invalid: "no server type",
+		},
+		{
+			name:    "no image",
+			spec:    NodeSpec{ServerType: "cx21"},
+			invalid: "no image",
+		},
+		{
+			name:    "unknown server type",
+			spec:    NodeSpec{ServerType: "cx99", Image: "ubuntu-20.04"},
+			invalid: `unknown server type "cx99"`,
+		},
+		{
+			name:    "deprecated image",
+			spec:    NodeSpec{ServerType: "cx21", Image: "ubuntu-16.04"},
+			invalid: `image "ubuntu-16.04" is deprecated`,
+		},
+		{
+			name:    "not offered in location",
+			spec:    NodeSpec{ServerType: "cx21", Image: "ubuntu-20.04", Location: "hel1"},
+			invalid: `not offered in location "hel1"`,
+		},
+		{
+			name:    "datacenter in another location",
+			spec:    NodeSpec{ServerType: "cx21", Image: "ubuntu-20.04", Location: "nbg1", Datacenter: "fsn1-dc14"},
+			invalid: `datacenter "fsn1-dc14" is not in location "nbg1"`,
+		},
+		{
+			name:    "not available in datacenter",
+			spec:    NodeSpec{ServerType: "cx21", Image: "ubuntu-20.04", Datacenter: "fsn1-dc8"},
+			invalid: `not available in datacenter "fsn1-dc8"`,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			hc := specAPI().client(t)
+
+			resolved, err := resolveSpec(context.Background(), hc, tc.spec)
+
+			if tc.invalid != "" {
+				if !errors.Is(err, ErrorInvalidNodeSpec) || !strings.Contains(err.Error(), tc.invalid) {
+					t.Fatalf("got error %v, want %s", err, tc.invalid)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if resolved.ServerType.Name != tc.spec.ServerType || resolved.Image.Name != tc.spec.Image {
+				t.Errorf("resolved %s on %s, want %s on %s", resolved.ServerType.Name, resolved.Image.Name, tc.spec.ServerType, tc.spec.Image)
+			}
+			if got := nameOf(resolved.Location); got != tc.location {
+				t.Errorf("location %q, want %q", got, tc.location)
+			}
+			if resolved.Datacenter == nil && tc.datacenter != "" || resolved.Datacenter != nil && resolved.Datacenter.Name != tc.datacenter {
+				t.Errorf("datacenter %v, want %q", resolved.Datacenter, tc.datacenter)
+			}
+			if resolved.Network == nil && tc.network != 0 || resolved.Network != nil && resolved.Network.ID != tc.network {
+				t.Errorf("network %v, want %d", resolved.Network, tc.network)
+			}
+		})
+	}
+}
+
+func TestSpecFor(t *testing.T) {
+	p := NewNodeProvider(
+		WithDefaultSpec(NodeSpec{ServerType: "default"}),
+		WithSpec(MasterSpec, NodeSpec{ServerType: "master"}),
+		WithSpec("gpu", NodeSpec{ServerType: "gpu"}),
+	)
+
+	cases := []struct {
+		name string
+		node ertia.Node
+		want string
+	}{
+		{name: "agent falls back to default", node: ertia.Node{}, want: "default"},
+		{name: "master", node: ertia.Node{IsMaster: true}, want: "master"},
+		{name: "tag before role", node: ertia.Node{IsMaster: true, Tags: []string{"gpu"}}, want: "gpu"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := p.specFor(&tc.node).ServerType; got != tc.want {
+				t.Errorf("got spec %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func nameOf(location *hcloud.Location) string {
+	if location == nil {
+		return ""
+	}
+	return location.Name
+}
@@ -2,10 +2,22 @@ package k3d
 
 import (
 	"context"
+	"errors"
+
 	ertia "github.com/ertia-io/config/pkg/entities"
 	"github.com/rs/zerolog/log"
 )
 
+var (
+	// ErrorReplaceUnsupported is returned by ReplaceNode. Earlier versions
+	// only reset the node status and reported success, without replacing
+	// anything.
+	ErrorReplaceUnsupported = errors.New("K3D.ReplaceUnsupported")
+)
+
+// K3DNodeProvider tracks nodes of a local k3d cluster. Unlike the cloud
+// providers it never drains nodes, stopping and deleting only change their
+// status.
 type K3DNodeProvider struct {
 }
 
@@ -53,14 +65,10 @@ func (p *K3DNodeProvider) StartNode(ctx context.Context, cfg *ertia.Project, nod
 	return cfg, nil
 }
 
+// ReplaceNode is not supported, k3d nodes are containers managed by k3d.
+// Recreate the node with k3d instead. This used to be a no-op status reset.
 func (p *K3DNodeProvider) ReplaceNode(ctx context.Context, cfg *ertia.Project, nodeId string) (*ertia.Project, error) {
-	node := cfg.FindNodeByID(nodeId)
-	if node.Status != ertia.NodeStatusReady {
-		node.Status = ertia.NodeStatusActive
-	}
-
-	cfg.UpdateNode(node)
-	return cfg, nil
+	return cfg, ErrorReplaceUnsupported
 }
 
 func (p *K3DNodeProvider) SyncNodes(ctx context.Context, cfg *ertia.Project) (*ertia.Project, error) {
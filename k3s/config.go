@@ -0,0 +1,268 @@
+package k3s
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	ertia "github.com/ertia-io/config/pkg/entities"
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v2"
+)
+
+const configPath = "/etc/rancher/k3s/config.yaml"
+
+var (
+	ErrorConfigKey = errors.New("K3S.ConfigKey")
+)
+
+// Project and node tag setting a k3s config key, e.g.
+// k3s-config:node-label=zone=fsn1 or k3s-config:cluster-cidr=10.42.0.0/16.
+// List keys add a value per tag.
+const configTag = "k3s-config:"
+
+// Config is rendered to /etc/rancher/k3s/config.yaml before k3s is
+// installed. Keys follow the k3s command line flags, anything without a
+// field can be set through Extra. Extra keys Config has a field for are
+// folded into the field.
+type Config struct {
+	// Server only.
+	Disable        []string `yaml:"disable,omitempty"`
+	ClusterCIDR    string   `yaml:"cluster-cidr,omitempty"`
+	ServiceCIDR    string   `yaml:"service-cidr,omitempty"`
+	ClusterDNS     string   `yaml:"cluster-dns,omitempty"`
+	TLSSANs        []string `yaml:"tls-san,omitempty"`
+	FlannelBackend string   `yaml:"flannel-backend,omitempty"`
+
+	// Server and agent.
+	NodeLabels  []string `yaml:"node-label,omitempty"`
+	NodeTaints  []string `yaml:"node-taint,omitempty"`
+	KubeletArgs []string `yaml:"kubelet-arg,omitempty"`
+
+	Extra map[string]interface{} `yaml:",inline"`
+}
+
+// Merge returns c with o applied on top. Lists are appended, other values
+// are replaced when set in o. Extra keys that cannot be folded into their
+// field are kept, Render reports them.
+func (c Config) Merge(o Config) Config {
+	if folded, err := c.fold(); err == nil {
+		c = folded
+	}
+	if folded, err := o.fold(); err == nil {
+		o = folded
+	}
+
+	merged := c
+
+	merged.Disable = appendUnique(c.Disable, o.Disable...)
+	merged.TLSSANs = appendUnique(c.TLSSANs, o.TLSSANs...)
+	merged.NodeLabels = appendUnique(c.NodeLabels, o.NodeLabels...)
+	merged.NodeTaints = appendUnique(c.NodeTaints, o.NodeTaints...)
+	merged.KubeletArgs = appendUnique(c.KubeletArgs, o.KubeletArgs...)
+
+	if o.ClusterCIDR != "" {
+		merged.ClusterCIDR = o.ClusterCIDR
+	}
+	if o.ServiceCIDR != "" {
+		merged.ServiceCIDR = o.ServiceCIDR
+	}
+	if o.ClusterDNS != "" {
+		merged.ClusterDNS = o.ClusterDNS
+	}
+	if o.FlannelBackend != "" {
+		merged.FlannelBackend = o.FlannelBackend
+	}
+
+	if len(c.Extra) > 0 || len(o.Extra) > 0 {
+		merged.Extra = map[string]interface{}{}
+		for k, v := range c.Extra {
+			merged.Extra[k] = v
+		}
+		for k, v := range o.Extra {
+			merged.Extra[k] = v
+		}
+	}
+
+	return merged
+}
+
+// Render returns the config as config.yaml content.
+func (c Config) Render() ([]byte, error) {
+	c, err := c.fold()
+	if err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(c)
+}
+
+// fold moves the Extra keys Config has a field for into the field, yaml
+// cannot render a key twice.
+func (c Config) fold() (Config, error) {
+	var extra map[string]interface{}
+
+	for key, v := range c.Extra {
+		if !(&Config{}).set(key, "") {
+			if extra == nil {
+				extra = map[string]interface{}{}
+			}
+			extra[key] = v
+			continue
+		}
+
+		values, err := extraValues(key, v)
+		if err != nil {
+			return c, err
+		}
+		for _, value := range values {
+			c.set(key, value)
+		}
+	}
+
+	c.Extra = extra
+	return c, nil
+}
+
+// extraValues returns the values of an Extra key Config has a field for.
+func extraValues(key string, v interface{}) ([]string, error) {
+	var values []string
+
+	switch v := v.(type) {
+	case string:
+		values = []string{v}
+	case []string:
+		values = v
+	case []interface{}:
+		for _, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("%w: %s takes strings, got %T", ErrorConfigKey, key, item)
+			}
+			values = append(values, s)
+		}
+	default:
+		return nil, fmt.Errorf("%w: %s takes strings, got %T", ErrorConfigKey, key, v)
+	}
+
+	if len(values) > 1 && !listKeys[key] {
+		return nil, fmt.Errorf("%w: %s takes a single value, got %d", ErrorConfigKey, key, len(values))
+	}
+	return values, nil
+}
+
+// listKeys are the keys of the list fields of Config.
+var listKeys = map[string]bool{
+	"disable":     true,
+	"tls-san":     true,
+	"node-label":  true,
+	"node-taint":  true,
+	"kubelet-arg": true,
+}
+
+// set sets the field for key, adding the value to list fields. It returns
+// false when Config has no field for key.
+func (c *Config) set(key, value string) bool {
+	switch key {
+	case "disable":
+		c.Disable = appendUnique(c.Disable, value)
+	case "cluster-cidr":
+		c.ClusterCIDR = value
+	case "service-cidr":
+		c.ServiceCIDR = value
+	case "cluster-dns":
+		c.ClusterDNS = value
+	case "tls-san":
+		c.TLSSANs = appendUnique(c.TLSSANs, value)
+	case "flannel-backend":
+		c.FlannelBackend = value
+	case "node-label":
+		c.NodeLabels = appendUnique(c.NodeLabels, value)
+	case "node-taint":
+		c.NodeTaints = appendUnique(c.NodeTaints, value)
+	case "kubelet-arg":
+		c.KubeletArgs = appendUnique(c.KubeletArgs, value)
+	default:
+		return false
+	}
+	return true
+}
+
+// ConfigFor picks the config for a node: the server or agent config of the
+// provider, merged with the configs registered for any of the node tags, then
+// with the config from the project tags and finally the node tags.
+func ConfigFor(ctx context.Context, cfg *ertia.Project, node *ertia.Node, server, agent Config, byTag map[string]Config) Config {
+	c := agent
+	if node.IsMaster {
+		c = server
+	}
+
+	for _, tag := range node.Tags {
+		if tc, ok := byTag[tag]; ok {
+			c = c.Merge(tc)
+		}
+	}
+
+	project := ConfigFromTags(ctx, cfg.Tags)
+	if !node.IsMaster {
+		project = project.agentOnly()
+	}
+
+	return c.Merge(project).Merge(ConfigFromTags(ctx, node.Tags))
+}
+
+// ConfigFromTags reads the k3s-config: tags. Keys without a field of Config
+// go to Extra.
+func ConfigFromTags(ctx context.Context, tags []string) Config {
+	var c Config
+
+	for _, tag := range tags {
+		if !strings.HasPrefix(tag, configTag) {
+			continue
+		}
+
+		kv := strings.SplitN(strings.TrimPrefix(tag, configTag), "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			log.Ctx(ctx).Warn().Str("tag", tag).Msg("Ignoring invalid k3s config")
+			continue
+		}
+		if !c.set(kv[0], kv[1]) {
+			if c.Extra == nil {
+				c.Extra = map[string]interface{}{}
+			}
+			c.Extra[kv[0]] = kv[1]
+		}
+	}
+
+	return c
+}
+
+// agentOnly drops the server only keys, project wide config applies to
+// agents too.
+func (c Config) agentOnly() Config {
+	c.Disable = nil
+	c.ClusterCIDR = ""
+	c.ServiceCIDR = ""
+	c.ClusterDNS = ""
+	c.TLSSANs = nil
+	c.FlannelBackend = ""
+	return c
+}
+
+func appendUnique(list []string, values ...string) []string {
+	out := append([]string{}, list...)
+Values:
+	for _, v := range values {
+		for _, existing := range out {
+			if existing == v {
+				continue Values
+			}
+		}
+		out = append(out, v)
+	}
+
+	if len(out) == 0 {
+		return nil
+	}
+	return out
+}
@@ -0,0 +1,78 @@
+package k3s_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/ertia-io/providers/k3s"
+)
+
+func TestRenderConfig(t *testing.T) {
+	cases := []struct {
+		name   string
+		config k3s.Config
+
+		want string
+		err  error
+	}{
+		{
+			name:   "typed and extra keys",
+			config: k3s.Config{ClusterCIDR: "10.42.0.0/16", Extra: map[string]interface{}{"protect-kernel-defaults": true}},
+			want:   "cluster-cidr: 10.42.0.0/16\nprotect-kernel-defaults: true\n",
+		},
+		{
+			name:   "extra value replaces field",
+			config: k3s.Config{ClusterCIDR: "10.42.0.0/16", Extra: map[string]interface{}{"cluster-cidr": "10.52.0.0/16"}},
+			want:   "cluster-cidr: 10.52.0.0/16\n",
+		},
+		{
+			name: "extra list extends field",
+			config: k3s.Config{Disable: []string{"traefik"}, Extra: map[string]interface{}{
+				"disable": []interface{}{"servicelb", "traefik"},
+			}},
+			want: "disable:\n- traefik\n- servicelb\n",
+		},
+		{
+			name:   "extra list for single value",
+			config: k3s.Config{Extra: map[string]interface{}{"cluster-dns": []string{"10.43.0.10", "10.43.0.11"}}},
+			err:    k3s.ErrorConfigKey,
+		},
+		{
+			name:   "extra value of another type",
+			config: k3s.Config{Extra: map[string]interface{}{"tls-san": 42}},
+			err:    k3s.ErrorConfigKey,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			rendered, err := tc.config.Render()
+
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("got error %v, want %v", err, tc.err)
+			}
+			if string(rendered) != tc.want {
+				t.Errorf("rendered\n%s\nwant\n%s", rendered, tc.want)
+			}
+		})
+	}
+}
+
+func TestMergeConfigFoldsExtra(t *testing.T) {
+	base := k3s.Config{NodeLabels: []string{"zone=fsn1"}}
+	tags := k3s.ConfigFromTags(context.Background(), []string{
+		"k3s-config:node-label=role=edge",
+		"k3s-config:protect-kernel-defaults=true",
+	})
+
+	merged := base.Merge(tags).Merge(k3s.Config{Extra: map[string]interface{}{"node-label": "disk=ssd"}})
+
+	want := "node-label:\n- zone=fsn1\n- role=edge\n- disk=ssd\nprotect-kernel-defaults: \"true\"\n"
+	if rendered, err := merged.Render(); err != nil || string(rendered) != want {
+		t.Errorf("rendered\n%s\nerror %v, want\n%s", rendered, err, want)
+	}
+	if _, ok := merged.Extra["node-label"]; ok {
+		t.Errorf("node-label left in Extra %v", merged.Extra)
+	}
+}
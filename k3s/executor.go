@@ -0,0 +1,213 @@
+package k3s
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	ertia "github.com/ertia-io/config/pkg/entities"
+	"github.com/fabled-se/goph"
+	"golang.org/x/crypto/ssh"
+)
+
+// Executor carries out the installer steps on a node.
+type Executor interface {
+	// Upload writes content to path on the node, readable by the owner
+	// only.
+	Upload(ctx context.Context, path string, content []byte) error
+
+	// RunEscalated runs cmd as root and returns its combined output.
+	RunEscalated(ctx context.Context, cmd string) ([]byte, error)
+
+	// RunEscalatedStream runs cmd as root like RunEscalated and hands each
+	// line of output to onLine as it arrives, stream is stdout or stderr.
+	RunEscalatedStream(ctx context.Context, cmd string, onLine func(stream, line string)) ([]byte, error)
+
+	// ReadFile returns the content of path, read as root.
+	ReadFile(ctx context.Context, path string) ([]byte, error)
+
+	Close() error
+}
+
+// Connector opens an Executor for a node. SSHConfig.Connect is the default.
+type Connector func(ctx context.Context, node ertia.Node) (Executor, error)
+
+type sshExecutor struct {
+	client  *goph.Client
+	bastion *ssh.Client
+
+	// key names the key file, or ssh-agent, the connection authenticated with.
+	key string
+
+	// release forgets the secrets of the node registered for the connection.
+	release func()
+}
+
+func (e *sshExecutor) Upload(ctx context.Context, path string, content []byte) error {
+	ftp, err := e.client.NewSftp()
+	if err != nil {
+		return err
+	}
+	defer ftp.Close()
+
+	// sftp does not take a context, closing the client aborts the write.
+	done := make(chan error, 1)
+	go func() {
+		remote, err := ftp.Create(path)
+		if err != nil {
+			done <- err
+			return
+		}
+		defer remote.Close()
+
+		// Uploads may hold tokens, only the owner reads them.
+		err = remote.Chmod(0600)
+		if err != nil {
+			done <- err
+			return
+		}
+
+		_, err = remote.Write(content)
+		done <- err
+	}()
+
+	select {
+	case err = <-done:
+		return err
+	case <-ctx.Done():
+		ftp.Close()
+		return ctx.Err()
+	}
+}
+
+func (e *sshExecutor) RunEscalated(ctx context.Context, cmd string) ([]byte, error) {
+	c, err := e.client.CommandContext(ctx, escalate(e.client.Config.Pass, cmd))
+	if err != nil {
+		return nil, err
+	}
+	return c.CombinedOutput()
+}
+
+func (e *sshExecutor) RunEscalatedStream(ctx context.Context, cmd string, onLine func(stream, line string)) ([]byte, error) {
+	sess, err := e.client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	defer sess.Close()
+
+	lines := &lineSplitter{onLine: onLine}
+	sess.Stdout = lines.writer("stdout")
+	sess.Stderr = lines.writer("stderr")
+
+	err = sess.Start(escalate(e.client.Config.Pass, cmd))
+	if err != nil {
+		return nil, err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- sess.Wait()
+	}()
+
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		_ = sess.Signal(ssh.SIGINT)
+		err = ctx.Err()
+	}
+
+	return lines.flush(), err
+}
+
+func (e *sshExecutor) ReadFile(ctx context.Context, path string) ([]byte, error) {
+	out, err := e.RunEscalated(ctx, "cat "+shellQuote(path))
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w: %s", path, err, remoteOutput(out))
+	}
+	return out, nil
+}
+
+func (e *sshExecutor) Close() error {
+	err := e.client.Close()
+	if e.bastion != nil {
+		e.bastion.Close()
+	}
+	if e.release != nil {
+		e.release()
+	}
+	return err
+}
+
+// escalate feeds the password to sudo ahead of the script, like goph's
+// RunContextEscalated. The heredoc delimiter is quoted so the password and
+// the script reach sudo as they are, without the login shell expanding $ or
+// backticks first.
+func escalate(pass, cmd string) string {
+	return fmt.Sprintf("cat | sudo --prompt=\"\" -S -- \"/usr/bin/sh\" << 'EOF'\n%s\n%s\nEOF\n", pass, cmd)
+}
+
+// lineSplitter collects the combined output of a command and hands out
+// complete lines as they are written.
+type lineSplitter struct {
+	mu       sync.Mutex
+	onLine   func(stream, line string)
+	combined bytes.Buffer
+	partial  map[string][]byte
+}
+
+type streamWriter struct {
+	stream string
+	lines  *lineSplitter
+}
+
+func (l *lineSplitter) writer(stream string) io.Writer {
+	return &streamWriter{stream: stream, lines: l}
+}
+
+func (w *streamWriter) Write(p []byte) (int, error) {
+	l := w.lines
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.combined.Write(p)
+
+	if l.partial == nil {
+		l.partial = map[string][]byte{}
+	}
+	buf := append(l.partial[w.stream], p...)
+	for {
+		i := bytes.IndexByte(buf, '\n')
+		if i < 0 {
+			break
+		}
+		l.emit(w.stream, buf[:i])
+		buf = buf[i+1:]
+	}
+	l.partial[w.stream] = append([]byte{}, buf...)
+
+	return len(p), nil
+}
+
+// flush hands out unterminated last lines and returns the combined output.
+func (l *lineSplitter) flush() []byte {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for stream, buf := range l.partial {
+		if len(buf) > 0 {
+			l.emit(stream, buf)
+		}
+	}
+	l.partial = nil
+
+	return append([]byte{}, l.combined.Bytes()...)
+}
+
+func (l *lineSplitter) emit(stream string, line []byte) {
+	if l.onLine != nil {
+		l.onLine(stream, strings.TrimRight(string(line), "\r"))
+	}
+}
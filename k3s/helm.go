@@ -0,0 +1,199 @@
+package k3s
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	ertia "github.com/ertia-io/config/pkg/entities"
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	ErrorHelmChartFailed = errors.New("K3S.HelmChartFailed")
+)
+
+// HelmChart resources are picked up by the helm controller built into k3s
+// from this namespace.
+const helmChartNamespace = "kube-system"
+
+// HelmChart is a chart installed by the helm controller of k3s.
+type HelmChart struct {
+	// Name is the release name, unique within the cluster.
+	Name string
+
+	// Repo is the chart repository URL, empty when Chart is a URL.
+	Repo    string
+	Chart   string
+	Version string
+
+	// Namespace is where the release is installed, created when missing.
+	// Without it the release goes to kube-system.
+	Namespace string
+
+	Values map[string]interface{}
+}
+
+type helmChartManifest struct {
+	APIVersion string            `yaml:"apiVersion"`
+	Kind       string            `yaml:"kind"`
+	Metadata   map[string]string `yaml:"metadata"`
+	Spec       helmChartSpec     `yaml:"spec"`
+}
+
+type helmChartSpec struct {
+	Repo            string `yaml:"repo,omitempty"`
+	Chart           string `yaml:"chart"`
+	Version         string `yaml:"version,omitempty"`
+	TargetNamespace string `yaml:"targetNamespace,omitempty"`
+	CreateNamespace bool   `yaml:"createNamespace,omitempty"`
+	ValuesContent   string `yaml:"valuesContent,omitempty"`
+}
+
+// Manifest renders the HelmChart resource.
+func (c HelmChart) Manifest() ([]byte, error) {
+	spec := helmChartSpec{
+		Repo:            c.Repo,
+		Chart:           c.Chart,
+		Version:         c.Version,
+		TargetNamespace: c.Namespace,
+		CreateNamespace: c.Namespace != "",
+	}
+
+	if len(c.Values) > 0 {
+		values, err := yaml.Marshal(c.Values)
+		if err != nil {
+			return nil, fmt.Errorf("values of %s: %w", c.Name, err)
+		}
+		spec.ValuesContent = string(values)
+	}
+
+	return yaml.Marshal(helmChartManifest{
+		APIVersion: "helm.cattle.io/v1",
+		Kind:       "HelmChart",
+		Metadata:   map[string]string{"name": c.Name, "namespace": helmChartNamespace},
+		Spec:       spec,
+	})
+}
+
+// Hash identifies the rendered chart, it changes with the repo, chart,
+// version, namespace or values.
+func (c HelmChart) Hash() (string, error) {
+	manifest, err := c.Manifest()
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(manifest)
+	return hex.EncodeToString(sum[:])[:16], nil
+}
+
+// jobName is the job the helm controller runs the install or upgrade in.
+func (c HelmChart) jobName() string {
+	return "helm-install-" + c.Name
+}
+
+// HelmChartStatus is the state of the last install or upgrade job of a chart.
+type HelmChartStatus struct {
+	// Job is the UID of the job, empty before the controller created it.
+	Job string
+
+	Succeeded bool
+
+	// Failed counts the failed attempts, the controller keeps retrying.
+	Failed int
+
+	// Message is the reason of the last failure, if any.
+	Message string
+}
+
+func (s HelmChartStatus) String() string {
+	switch {
+	case s.Job == "":
+		return "waiting for the helm controller"
+	case s.Succeeded:
+		return "deployed"
+	case s.Failed > 0:
+		return fmt.Sprintf("%d failed attempts: %s", s.Failed, s.Message)
+	}
+	return "installing"
+}
+
+// GetHelmChartStatus reads the status of the chart from the cluster.
+func GetHelmChartStatus(ctx context.Context, connect Connector, server ertia.Node, chart HelmChart) (HelmChartStatus, error) {
+	out, err := Kubectl(ctx, connect, server, "get", "job", chart.jobName(), "-n", helmChartNamespace, "--ignore-not-found", "-o",
+		`jsonpath={.metadata.uid}|{.status.succeeded}|{.status.failed}|{.status.conditions[?(@.type=="Failed")].message}`)
+	if err != nil {
+		return HelmChartStatus{}, err
+	}
+
+	parts := strings.SplitN(strings.TrimSpace(string(out)), "|", 4)
+	for len(parts) < 4 {
+		parts = append(parts, "")
+	}
+
+	var status HelmChartStatus
+	status.Job = parts[0]
+	status.Succeeded = parts[1] != "" && parts[1] != "0"
+	fmt.Sscanf(parts[2], "%d", &status.Failed)
+	status.Message = parts[3]
+	return status, nil
+}
+
+// InstallHelmChart applies the chart through the server and waits until the
+// helm controller has installed or upgraded it. When the timeout expires the
+// error carries the last status and the output of the job.
+func InstallHelmChart(ctx context.Context, connect Connector, server ertia.Node, chart HelmChart, timeout time.Duration) error {
+	manifest, err := chart.Manifest()
+	if err != nil {
+		return err
+	}
+
+	before, err := GetHelmChartStatus(ctx, connect, server, chart)
+	if err != nil {
+		return err
+	}
+
+	changed, err := applyManifest(ctx, connect, server, manifest)
+	if err != nil {
+		return err
+	}
+	log.Ctx(ctx).Info().Str("chart", chart.Name).Bool("changed", changed).Msg("Applied helm chart")
+
+	deadline := time.Now().Add(timeout)
+	for {
+		status, err := GetHelmChartStatus(ctx, connect, server, chart)
+		switch {
+		case err != nil:
+			log.Ctx(ctx).Debug().Err(err).Str("chart", chart.Name).Msg("Could not read helm chart status")
+		case changed && status.Job == before.Job:
+			// The controller has not replaced the job of the last
+			// install yet.
+		case status.Succeeded:
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%w: %s: %s%s", ErrorHelmChartFailed, chart.Name, status, helmJobLogs(ctx, connect, server, chart))
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w: %s: %s", ctx.Err(), chart.Name, status)
+		case <-time.After(nodePollInterval):
+		}
+	}
+}
+
+// helmJobLogs returns the tail of the job output to explain a failure.
+func helmJobLogs(ctx context.Context, connect Connector, server ertia.Node, chart HelmChart) string {
+	out, err := Kubectl(ctx, connect, server, "logs", "job/"+chart.jobName(), "-n", helmChartNamespace, "--tail=20")
+	if err != nil || len(out) == 0 {
+		return ""
+	}
+	return "\n" + remoteOutput(out)
+}
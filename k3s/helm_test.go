@@ -0,0 +1,82 @@
+package k3s_test
+
+import (
+	"testing"
+
+	"github.com/ertia-io/providers/k3s"
+)
+
+func certManager() k3s.HelmChart {
+	return k3s.HelmChart{
+		Name:      "cert-manager",
+		Repo:      "https://charts.jetstack.io",
+		Chart:     "cert-manager",
+		Version:   "v1.8.0",
+		Namespace: "cert-manager",
+		Values:    map[string]interface{}{"installCRDs": true, "replicaCount": 2},
+	}
+}
+
+func TestHelmChartManifest(t *testing.T) {
+	manifest, err := certManager().Manifest()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := `apiVersion: helm.cattle.io/v1
+kind: HelmChart
+metadata:
+  name: cert-manager
+  namespace: kube-system
+spec:
+  repo: https://charts.jetstack.io
+  chart: cert-manager
+  version: v1.8.0
+  targetNamespace: cert-manager
+  createNamespace: true
+  valuesContent: |
+    installCRDs: true
+    replicaCount: 2
+`
+	if string(manifest) != want {
+		t.Errorf("got manifest\n%s\nwant\n%s", manifest, want)
+	}
+}
+
+func TestHelmChartHash(t *testing.T) {
+	hash := func(c k3s.HelmChart) string {
+		t.Helper()
+		h, err := c.Hash()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return h
+	}
+
+	base := hash(certManager())
+	for i := 0; i < 10; i++ {
+		if h := hash(certManager()); h != base {
+			t.Fatalf("hash %s changed to %s without a change", base, h)
+		}
+	}
+
+	cases := []struct {
+		name   string
+		change func(c *k3s.HelmChart)
+	}{
+		{name: "value", change: func(c *k3s.HelmChart) { c.Values["replicaCount"] = 3 }},
+		{name: "new value", change: func(c *k3s.HelmChart) { c.Values["prometheus"] = map[string]interface{}{"enabled": false} }},
+		{name: "version", change: func(c *k3s.HelmChart) { c.Version = "v1.9.0" }},
+		{name: "namespace", change: func(c *k3s.HelmChart) { c.Namespace = "" }},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := certManager()
+			tc.change(&c)
+			if hash(c) == base {
+				t.Errorf("hash %s did not change", base)
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package k3s
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	ertia "github.com/ertia-io/config/pkg/entities"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	ErrorHostKeyUnknown = errors.New("SSH.HostKeyUnknown")
+	ErrorHostKeyChanged = errors.New("SSH.HostKeyChanged")
+)
+
+// NodeHostKey returns the SSH host key recorded for the node, in
+// authorized_keys format.
+func NodeHostKey(node *ertia.Node) string {
+	return nodeTag(node, hostKeyTag)
+}
+
+// SetNodeHostKey records the SSH host key of the node, in authorized_keys
+// format. Later connections only accept this key.
+func SetNodeHostKey(node *ertia.Node, key string) {
+	setNodeTag(node, hostKeyTag, strings.TrimSpace(key))
+}
+
+// TrustHostKey records the host key the node presents on first contact over
+// SSH with c. Nodes with a recorded key are left alone, the key is enforced
+// when connecting.
+func TrustHostKey(ctx context.Context, c SSHConfig, node *ertia.Node) error {
+	if NodeHostKey(node) != "" {
+		return nil
+	}
+
+	exec, key, err := dialNode(ctx, c, *node, true)
+	if err != nil {
+		return err
+	}
+	exec.Close()
+
+	SetNodeHostKey(node, string(ssh.MarshalAuthorizedKey(key)))
+	log.Ctx(ctx).Info().
+		Str("node", node.Name).
+		Str("fingerprint", ssh.FingerprintSHA256(key)).
+		Str("key", exec.key).
+		Msg("Trusting SSH host key")
+
+	return nil
+}
+
+// hostKeyCheck verifies the key a node presents against the recorded one.
+// The ssh package flattens callback errors, so the outcome is kept here.
+type hostKeyCheck struct {
+	node      string
+	expected  string
+	trustNew  bool
+	presented ssh.PublicKey
+	err       error
+}
+
+func (c *hostKeyCheck) callback(_ string, _ net.Addr, key ssh.PublicKey) error {
+	c.presented = key
+
+	if c.expected == "" {
+		if c.trustNew {
+			return nil
+		}
+		c.err = fmt.Errorf("%w: %s", ErrorHostKeyUnknown, c.node)
+		return c.err
+	}
+
+	expected, _, _, _, err := ssh.ParseAuthorizedKey([]byte(c.expected))
+	if err != nil {
+		c.err = fmt.Errorf("%w: %s: recorded key unreadable: %v", ErrorHostKeyChanged, c.node, err)
+		return c.err
+	}
+
+	if !bytes.Equal(expected.Marshal(), key.Marshal()) {
+		c.err = fmt.Errorf("%w: %s presented %s, expected %s",
+			ErrorHostKeyChanged, c.node, ssh.FingerprintSHA256(key), ssh.FingerprintSHA256(expected))
+		return c.err
+	}
+
+	return nil
+}
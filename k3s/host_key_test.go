@@ -0,0 +1,165 @@
+package k3s
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	ertia "github.com/ertia-io/config/pkg/entities"
+	"golang.org/x/crypto/ssh"
+)
+
+func newHostKey(t *testing.T) ssh.Signer {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// sshServer accepts any client with hostKey and refuses every channel. It
+// returns the host:port it listens on.
+func sshServer(t *testing.T, hostKey ssh.Signer) string {
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(hostKey)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, chans, reqs, err := ssh.NewServerConn(conn, config)
+				if err != nil {
+					return
+				}
+				go ssh.DiscardRequests(reqs)
+				for ch := range chans {
+					ch.Reject(ssh.Prohibited, "no channels")
+				}
+			}()
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+func authorizedKey(key ssh.PublicKey) string {
+	return string(ssh.MarshalAuthorizedKey(key))
+}
+
+func TestHostKeyCheck(t *testing.T) {
+	hostKey := newHostKey(t)
+	otherKey := newHostKey(t)
+	addr := sshServer(t, hostKey)
+
+	cases := []struct {
+		name     string
+		expected string
+		trustNew bool
+		err      error
+	}{
+		{name: "recorded key", expected: authorizedKey(hostKey.PublicKey())},
+		{name: "first contact trusted", trustNew: true},
+		{name: "first contact not trusted", err: ErrorHostKeyUnknown},
+		{name: "changed key", expected: authorizedKey(otherKey.PublicKey()), err: ErrorHostKeyChanged},
+		{name: "unreadable recorded key", expected: "ssh-ed25519 garbage", err: ErrorHostKeyChanged},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			check := &hostKeyCheck{node: "node", expected: tc.expected, trustNew: tc.trustNew}
+
+			client, _, err := SSHConfig{}.dial(context.Background(), addr, &ssh.ClientConfig{
+				User:            "ertia",
+				Timeout:         time.Second,
+				HostKeyCallback: check.callback,
+			})
+			if client != nil {
+				client.Close()
+			}
+
+			if tc.err == nil {
+				if err != nil || check.err != nil {
+					t.Fatalf("unexpected error: %v, %v", err, check.err)
+				}
+				if authorizedKey(check.presented) != authorizedKey(hostKey.PublicKey()) {
+					t.Errorf("presented key %s not kept", ssh.FingerprintSHA256(check.presented))
+				}
+				return
+			}
+			if err == nil || !errors.Is(check.err, tc.err) {
+				t.Fatalf("got error %v, check error %v, want %v", err, check.err, tc.err)
+			}
+		})
+	}
+}
+
+func TestTrustHostKeyKeepsRecordedKey(t *testing.T) {
+	recorded := authorizedKey(newHostKey(t).PublicKey())
+
+	node := &ertia.Node{Name: "node"}
+	SetNodeHostKey(node, recorded)
+
+	// The node has no address, dialling it would fail.
+	if err := TrustHostKey(context.Background(), SSHConfig{}, node); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if NodeHostKey(node) != strings.TrimSpace(recorded) {
+		t.Errorf("recorded key replaced by %s", NodeHostKey(node))
+	}
+}
+
+func TestBastionHostKey(t *testing.T) {
+	hostKey := newHostKey(t)
+	addr := sshServer(t, hostKey)
+
+	cases := []struct {
+		name    string
+		hostKey string
+		err     error
+	}{
+		{name: "recorded key", hostKey: authorizedKey(hostKey.PublicKey())},
+		{name: "changed key", hostKey: authorizedKey(newHostKey(t).PublicKey()), err: ErrorHostKeyChanged},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := SSHConfig{Bastion: addr, BastionHostKey: tc.hostKey}
+
+			_, _, err := c.dial(context.Background(), "10.0.0.1:22", &ssh.ClientConfig{
+				User:            "ertia",
+				Timeout:         time.Second,
+				HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+			})
+
+			if tc.err != nil {
+				if !errors.Is(err, tc.err) {
+					t.Fatalf("got error %v, want %v", err, tc.err)
+				}
+				return
+			}
+			// The bastion is trusted, it refuses to forward to the node.
+			if err == nil || !strings.Contains(err.Error(), "through bastion") {
+				t.Fatalf("got error %v, want the bastion to be reached", err)
+			}
+		})
+	}
+}
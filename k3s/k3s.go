@@ -4,16 +4,11 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"io/ioutil"
-	"net"
 	"path/filepath"
 	"strings"
-	"time"
 
-	"github.com/ertia-io/config/pkg/config"
 	ertia "github.com/ertia-io/config/pkg/entities"
-	"github.com/fabled-se/goph"
-	"github.com/rs/zerolog/log"
+	"github.com/ertia-io/providers/redact"
 	"github.com/segmentio/ksuid"
 )
 
@@ -21,188 +16,393 @@ var (
 	ErrorSSHNotReady = errors.New("SSH.NotReady")
 )
 
-func getServerInstallCmd(id, channel string) string {
-	return fmt.Sprintf("INSTALL_K3S_CHANNEL=%s /tmp/%s", channel, id)
+// Project tag setting the control plane endpoint of the cluster, e.g.
+// control-plane-endpoint:k8s.example.com.
+const endpointTag = "control-plane-endpoint:"
+
+// EndpointFor reads the control plane endpoint from the project tags, falling
+// back to the endpoint configured on the provider.
+func EndpointFor(cfg *ertia.Project, fallback string) string {
+	if endpoint := findTag(cfg.Tags, endpointTag); endpoint != "" {
+		return endpoint
+	}
+	return fallback
 }
 
-func getAgentInstallCmd(nodeToken, masterIp, id, channel string) string {
-	return fmt.Sprintf(
-		"INSTALL_K3S_CHANNEL=%s K3S_URL=https://%s:6443 K3S_TOKEN=%s /tmp/%s",
-		channel, masterIp, strings.ReplaceAll(nodeToken, "\n", ""), id,
-	)
+// InstallOptions configure how k3s is installed on a node.
+type InstallOptions struct {
+	Channel string
+
+	// Version pins an exact k3s release, e.g. v1.24.3+k3s1, and takes
+	// precedence over Channel.
+	Version string
+
+	// Endpoint is the control plane endpoint. Servers get it as TLS SAN
+	// and the kubeconfig points at it.
+	Endpoint string
+
+	// ClusterInit starts the first server with embedded etcd.
+	ClusterInit bool
+
+	Config Config
+
+	// SSH configures how nodes are reached, see SSHConfigFor.
+	SSH SSHConfig
+
+	// Connect opens the connection the installer and cluster commands run
+	// through, SSH with the SSH config when unset.
+	Connect Connector
+
+	// Progress receives an event for every install phase. Events are
+	// dropped while the channel is full, so it should be buffered.
+	Progress chan<- Progress
+
+	// Timeouts bound the install phases, unset ones use DefaultTimeouts.
+	Timeouts Timeouts
+
+	// Kubeconfig configures where the kubeconfig of a new cluster goes.
+	Kubeconfig KubeconfigOptions
+
+	// ExternalCloudProvider is set when a cloud controller manager is
+	// installed after k3s. Nodes stay tainted until it runs, so readiness
+	// only waits for the node itself.
+	ExternalCloudProvider bool
 }
 
-func chmodInstaller(id string) string {
-	return fmt.Sprintf("chmod +x /tmp/%s", id)
+// Connector returns Connect, or SSH with the SSH config when it is unset.
+func (o InstallOptions) Connector() Connector {
+	if o.Connect == nil {
+		return o.SSH.Connect
+	}
+	return o.Connect
 }
 
-func getNodeTokenCmd() string {
-	return fmt.Sprintf("cat /var/lib/rancher/k3s/server/node-token")
+// TrustHostKey records the SSH host key of the node on first contact. There
+// is nothing to trust when the options connect some other way.
+func (o InstallOptions) TrustHostKey(ctx context.Context, node *ertia.Node) error {
+	if o.Connect != nil {
+		return nil
+	}
+	return TrustHostKey(ctx, o.SSH, node)
 }
 
-func getK3SYamlCmd() string {
-	return fmt.Sprintf("cat /etc/rancher/k3s/k3s.yaml")
+func (o InstallOptions) connect(ctx context.Context, node ertia.Node) (Executor, error) {
+	return o.Connector()(ctx, node)
 }
 
-func UploadK3SInstaller(c *goph.Client, id string) error {
-	ftp, err := c.NewSftp()
-	if err != nil {
-		return nil
+// serverConfig adds what the install itself needs to the server config.
+func (o InstallOptions) serverConfig() Config {
+	if o.Endpoint == "" {
+		return o.Config
 	}
-	defer ftp.Close()
+	return o.Config.Merge(Config{TLSSANs: []string{o.Endpoint}})
+}
 
-	remote, err := ftp.Create("/tmp/" + id)
-	if err != nil {
-		return err
+// installEnv selects the release to install.
+func (o InstallOptions) installEnv() string {
+	if o.Version != "" {
+		return fmt.Sprintf("INSTALL_K3S_VERSION=%s", o.Version)
 	}
-	defer remote.Close()
+	return fmt.Sprintf("INSTALL_K3S_CHANNEL=%s", o.Channel)
+}
 
-	_, err = remote.Write([]byte(installer))
+func getServerInstallCmd(id, env string, clusterInit bool) string {
+	if clusterInit {
+		return fmt.Sprintf("%s /tmp/%s server --cluster-init", env, id)
+	}
+	return fmt.Sprintf("%s /tmp/%s server", env, id)
+}
 
-	return err
+func getAgentInstallCmd(nodeToken, masterIp, id, env string) string {
+	return fmt.Sprintf(
+		"%s K3S_URL=https://%s:6443 K3S_TOKEN=%s /tmp/%s",
+		env, masterIp, strings.ReplaceAll(nodeToken, "\n", ""), id,
+	)
 }
 
-func InstallK3SServer(ctx context.Context, ip net.IP, user, password, channel string) (string, error) {
-	fmt.Println("Installing K3S Server")
+func getServerJoinCmd(nodeToken, serverIp, id, env string) string {
+	return fmt.Sprintf(
+		"%s K3S_URL=https://%s:6443 K3S_TOKEN=%s /tmp/%s server",
+		env, serverIp, strings.ReplaceAll(nodeToken, "\n", ""), id,
+	)
+}
+
+// getServerUpgradeCmd reruns the server install of the first server, with
+// --cluster-init when it runs embedded etcd.
+func getServerUpgradeCmd(id, env string) string {
+	return fmt.Sprintf(
+		"if [ -d %s ]; then %s; else %s; fi",
+		etcdDataPath, getServerInstallCmd(id, env, true), getServerInstallCmd(id, env, false),
+	)
+}
+
+func getVersionCmd() string {
+	return "k3s --version"
+}
+
+func getKillAllCmd() string {
+	return "/usr/local/bin/k3s-killall.sh"
+}
+
+func installConfigCmd(id string) string {
+	return fmt.Sprintf("mkdir -p %s && mv /tmp/%s.yaml %s && chmod 600 %s", filepath.Dir(configPath), id, configPath, configPath)
+}
+
+func chmodInstaller(id string) string {
+	return fmt.Sprintf("chmod +x /tmp/%s", id)
+}
 
-	sshClient, err := tryEstablishSSHConnection(ctx, ip.String(), user, password)
+const (
+	nodeTokenPath  = "/var/lib/rancher/k3s/server/node-token"
+	kubeconfigPath = "/etc/rancher/k3s/k3s.yaml"
+	etcdDataPath   = "/var/lib/rancher/k3s/server/db/etcd"
+)
+
+// UploadK3SConfig uploads the rendered config next to the installer, it is
+// moved into place with installConfigCmd.
+func UploadK3SConfig(ctx context.Context, exec Executor, id string, cfg Config) error {
+	rendered, err := cfg.Render()
 	if err != nil {
-		fmt.Println("Server not ready for SSH, retry")
-		log.Ctx(ctx).Err(err).Send()
-		return "", err
+		return err
 	}
 
-	defer sshClient.Close()
+	return exec.Upload(ctx, "/tmp/"+id+".yaml", rendered)
+}
 
-	timeoutCtx, cancel := context.WithTimeout(ctx, time.Second*60)
-	defer cancel()
+func UploadK3SInstaller(ctx context.Context, exec Executor, id string) error {
+	return exec.Upload(ctx, "/tmp/"+id, []byte(installer))
+}
 
-	id := ksuid.New().String()
+// InstallK3SServer installs the first server of a cluster. With ClusterInit
+// the server runs embedded etcd so that more servers can join it. The
+// kubeconfig is written as configured by opts.Kubeconfig, pointing at the
+// endpoint, or at the node IP when there is none.
+func InstallK3SServer(ctx context.Context, node ertia.Node, opts InstallOptions) (string, error) {
+	timeouts := opts.Timeouts.orDefault()
 
-	err = UploadK3SInstaller(sshClient, id)
-	if err != nil {
-		fmt.Println("Error:", err.Error())
+	fail := func(err error) (string, error) {
+		opts.progress(ctx, node.Name, PhaseFailed, err)
 		return "", err
 	}
 
-	out, err := sshClient.RunContextEscalated(timeoutCtx, chmodInstaller(id))
+	exec, err := opts.connectPhase(ctx, node)
 	if err != nil {
-		fmt.Println("Error:", string(out))
-		log.Ctx(ctx).Err(err).Msg(string(out))
-		return "", err
+		return fail(err)
 	}
 
-	out, err = sshClient.RunContextEscalated(timeoutCtx, getServerInstallCmd(id, channel))
+	defer exec.Close()
+
+	cfg := opts.serverConfig()
+	err = installK3S(ctx, exec, node, opts, &cfg, func(id string) string {
+		return getServerInstallCmd(id, opts.installEnv(), opts.ClusterInit)
+	})
 	if err != nil {
-		fmt.Println("Err: " + err.Error())
-		fmt.Println(string(out))
-		log.Ctx(ctx).Err(err).Msg(string(out))
-		return string(out), errors.New(fmt.Sprintf("Error: %s", out))
+		return fail(err)
 	}
 
-	nodeToken, err := sshClient.RunContextEscalated(timeoutCtx, getNodeTokenCmd())
-	if err != nil {
+	var nodeToken, out []byte
 
-		fmt.Println("OUT ", string(nodeToken))
-		log.Ctx(ctx).Err(err).Msg(string(nodeToken))
-		return "", err
+	opts.progress(ctx, node.Name, PhaseFetchingToken, nil)
+	err = withTimeout(ctx, node.Name, PhaseFetchingToken, timeouts.Upload, func(ctx context.Context) error {
+		nodeToken, err = exec.ReadFile(ctx, nodeTokenPath)
+		return err
+	})
+	if err != nil {
+		return fail(err)
 	}
+	defer redact.Secret(string(nodeToken))()
 
-	out, err = sshClient.RunContextEscalated(timeoutCtx, getK3SYamlCmd())
+	opts.progress(ctx, node.Name, PhaseFetchingKubeconfig, nil)
+	err = withTimeout(ctx, node.Name, PhaseFetchingKubeconfig, timeouts.Upload, func(ctx context.Context) error {
+		out, err = exec.ReadFile(ctx, kubeconfigPath)
+		return err
+	})
 	if err != nil {
-
-		fmt.Println("Could not fetch K3S Yaml ", string(out))
-		log.Ctx(ctx).Err(err).Msg(string(out))
-		return "", errors.New(fmt.Sprintf("Error: %s", out))
+		return fail(err)
 	}
 
-	out = []byte(strings.ReplaceAll(string(out), "127.0.0.1", ip.String()))
-
-	err = ioutil.WriteFile(config.ErtiaKubePath()+"/config", out, 0600)
+	endpoint := opts.Endpoint
+	if endpoint == "" {
+		endpoint = node.IPV4.String()
+	}
 
+	err = WriteKubeconfig(out, endpoint, opts.Kubeconfig)
 	if err != nil {
-		fmt.Println("Could not write Kubeconfig Yaml ", string(out))
-		log.Ctx(ctx).Err(err).Msg(string(out))
-		return "", err
+		return fail(err)
 	}
-	fmt.Println("NT: ", nodeToken)
+
+	opts.progress(ctx, node.Name, PhaseDone, nil)
 
 	return string(nodeToken), nil
 }
 
-func InstallK3SAgent(ctx context.Context, node ertia.Node, masterIp, channel string) error {
-	fmt.Println("Installing K3S Agent")
-	sshClient, err := tryEstablishSSHConnection(ctx, node.IPV4.String(), node.InstallUser, node.InstallPassword)
-	if err != nil {
-		fmt.Println("Server not ready for SSH, retry")
-		log.Ctx(ctx).Err(err).Send()
-		return err
-	}
-
-	defer sshClient.Close()
+func InstallK3SAgent(ctx context.Context, node ertia.Node, masterIp string, opts InstallOptions) error {
+	return runK3SInstaller(ctx, node, opts, &opts.Config, func(id string) string {
+		return getAgentInstallCmd(node.NodeToken, masterIp, id, opts.installEnv())
+	})
+}
 
-	timeoutCtx, cancel := context.WithTimeout(ctx, time.Second*60)
-	defer cancel()
+// JoinK3SServer installs k3s on the node as an additional server of the
+// cluster reachable at serverIp, which may be the control plane endpoint.
+// The cluster must run embedded etcd.
+func JoinK3SServer(ctx context.Context, node ertia.Node, serverIp string, opts InstallOptions) error {
+	cfg := opts.serverConfig()
+	return runK3SInstaller(ctx, node, opts, &cfg, func(id string) string {
+		return getServerJoinCmd(node.NodeToken, serverIp, id, opts.installEnv())
+	})
+}
 
-	id := ksuid.New().String()
+// UpgradeK3S reruns the installer on a node that runs k3s already, with the
+// version of opts, in the role the node has. The config.yaml on the node is
+// kept and no token or kubeconfig is fetched. serverIp is where the node
+// joined the cluster, empty for the first server.
+func UpgradeK3S(ctx context.Context, node ertia.Node, serverIp string, opts InstallOptions) error {
+	return runK3SInstaller(ctx, node, opts, nil, func(id string) string {
+		switch {
+		case !node.IsMaster:
+			return getAgentInstallCmd(node.NodeToken, serverIp, id, opts.installEnv())
+		case serverIp != "":
+			return getServerJoinCmd(node.NodeToken, serverIp, id, opts.installEnv())
+		}
+		return getServerUpgradeCmd(id, opts.installEnv())
+	})
+}
 
-	err = UploadK3SInstaller(sshClient, id)
+func runK3SInstaller(ctx context.Context, node ertia.Node, opts InstallOptions, cfg *Config, installCmd func(id string) string) error {
+	exec, err := opts.connectPhase(ctx, node)
 	if err != nil {
-		fmt.Println("Error:", err.Error())
+		opts.progress(ctx, node.Name, PhaseFailed, err)
 		return err
 	}
 
-	out, err := sshClient.RunContextEscalated(timeoutCtx, chmodInstaller(id))
-	if err != nil {
-		fmt.Println("Error:", string(out))
-		log.Ctx(ctx).Err(err).Msg(string(out))
-		return err
-	}
+	defer exec.Close()
 
-	out, err = sshClient.RunContextEscalated(timeoutCtx, getAgentInstallCmd(node.NodeToken, masterIp, id, channel))
+	err = installK3S(ctx, exec, node, opts, cfg, installCmd)
 	if err != nil {
-		fmt.Println("Error:", string(out))
-		log.Ctx(ctx).Err(err).Msg(string(out))
+		opts.progress(ctx, node.Name, PhaseFailed, err)
 		return err
 	}
 
+	opts.progress(ctx, node.Name, PhaseDone, nil)
 	return nil
 }
 
-func tryEstablishSSHConnection(ctx context.Context, ipStr string, user string, password string) (*goph.Client, error) {
+// connectPhase connects to the node within the connect timeout.
+func (o InstallOptions) connectPhase(ctx context.Context, node ertia.Node) (Executor, error) {
+	o.progress(ctx, node.Name, PhaseConnecting, nil)
 
-	keyFiles, err := ioutil.ReadDir(config.ErtiaKeysPath())
-	if err != nil {
-		return nil, err
-	}
+	var exec Executor
+	err := withTimeout(ctx, node.Name, PhaseConnecting, o.Timeouts.orDefault().Connect, func(ctx context.Context) error {
+		var err error
+		exec, err = o.connect(ctx, node)
+		return err
+	})
+	return exec, err
+}
+
+// installK3S uploads the installer and config and runs the install command,
+// streaming its output to the log. Without cfg the config on the node is
+// kept.
+func installK3S(ctx context.Context, exec Executor, node ertia.Node, opts InstallOptions, cfg *Config, installCmd func(id string) string) error {
+	timeouts := opts.Timeouts.orDefault()
+	id := ksuid.New().String()
 
-	var client *goph.Client
-	for _, keyFile := range keyFiles {
+	opts.progress(ctx, node.Name, PhaseUploading, nil)
 
-		if strings.Contains(keyFile.Name(), ".pub") {
-			continue
+	err := withTimeout(ctx, node.Name, PhaseUploading, timeouts.Upload, func(ctx context.Context) error {
+		err := UploadK3SInstaller(ctx, exec, id)
+		if err != nil {
+			return err
 		}
-		// Start new ssh connection with private key.
-		auth, err := goph.Key(filepath.Join(config.ErtiaKeysPath(), keyFile.Name()), "")
+
+		out, err := exec.RunEscalated(ctx, chmodInstaller(id))
 		if err != nil {
-			fmt.Println(err)
-			log.Ctx(ctx).Err(err).Send()
-			continue
+			return fmt.Errorf("%w: %s", err, remoteOutput(out))
+		}
+
+		if cfg == nil {
+			return nil
 		}
 
-		client, err = goph.NewUnknown(user, ipStr, auth)
+		err = UploadK3SConfig(ctx, exec, id, *cfg)
 		if err != nil {
-			fmt.Println(err)
-			log.Ctx(ctx).Err(err).Send()
-			continue
+			return err
 		}
 
-		client.SetPass(password)
+		out, err = exec.RunEscalated(ctx, installConfigCmd(id))
+		if err != nil {
+			return fmt.Errorf("%w: %s", err, remoteOutput(out))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	opts.progress(ctx, node.Name, PhaseInstalling, nil)
+
+	return withTimeout(ctx, node.Name, PhaseInstalling, timeouts.Install, func(ctx context.Context) error {
+		out, err := exec.RunEscalatedStream(ctx, installCmd(id), logLines(ctx, node.Name, PhaseInstalling))
+		if err != nil {
+			return fmt.Errorf("%w: %s", err, lastLine(out))
+		}
+		return nil
+	})
+}
+
+// lastLine returns the last non-empty line of out, usually the reason an
+// installer gave up.
+func lastLine(out []byte) string {
+	lines := strings.Split(remoteOutput(out), "\n")
+	return lines[len(lines)-1]
+}
+
+// remoteOutput is command output fit for errors and logs.
+func remoteOutput(out []byte) string {
+	return redact.String(strings.TrimSpace(string(out)))
+}
+
+// InstalledVersion asks the node which k3s version it runs.
+func InstalledVersion(ctx context.Context, connect Connector, node ertia.Node) (string, error) {
+	exec, err := connect(ctx, node)
+	if err != nil {
+		return "", err
+	}
+	defer exec.Close()
+
+	out, err := exec.RunEscalated(ctx, getVersionCmd())
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", err, remoteOutput(out))
+	}
 
-		return client, nil
+	return parseVersion(string(out))
+}
+
+// StopK3S stops k3s on the node and kills its containers, so a node that is
+// being removed does not register with the cluster again.
+func StopK3S(ctx context.Context, connect Connector, node ertia.Node) error {
+	exec, err := connect(ctx, node)
+	if err != nil {
+		return err
 	}
+	defer exec.Close()
 
-	return nil, ErrorSSHNotReady
+	out, err := exec.RunEscalated(ctx, getKillAllCmd())
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, remoteOutput(out))
+	}
+	return nil
+}
+
+// parseVersion reads the release from "k3s version v1.24.3+k3s1 (990ba0e8)".
+func parseVersion(out string) (string, error) {
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 3 && fields[0] == "k3s" && fields[1] == "version" {
+			return fields[2], nil
+		}
+	}
+	return "", fmt.Errorf("could not find k3s version in: %s", strings.TrimSpace(out))
 }
 
 func InitK3SServer() {
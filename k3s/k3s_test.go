@@ -0,0 +1,334 @@
+package k3s_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	ertia "github.com/ertia-io/config/pkg/entities"
+	"github.com/ertia-io/providers/k3s"
+	"github.com/ertia-io/providers/k3s/k3stest"
+)
+
+const (
+	nodeTokenPath  = "/var/lib/rancher/k3s/server/node-token"
+	kubeconfigPath = "/etc/rancher/k3s/k3s.yaml"
+)
+
+const serverKubeconfig = `apiVersion: v1
+kind: Config
+clusters:
+- name: default
+  cluster:
+    server: https://127.0.0.1:6443
+contexts:
+- name: default
+  context:
+    cluster: default
+    user: default
+users:
+- name: default
+  user:
+    token: secret
+current-context: default
+`
+
+var errExit = errors.New("Process exited with status 1")
+
+type installCase struct {
+	name  string
+	setup func(f *k3stest.FakeExecutor, opts *k3s.InstallOptions)
+
+	// commands are expected to run in this order, matched as substrings.
+	// Consecutive entries may match the same command.
+	commands []string
+
+	// config is expected in the uploaded config.yaml.
+	config string
+
+	// err is matched with errors.Is, as is notReady when set.
+	err      error
+	notReady bool
+	phase    k3s.Phase
+}
+
+func runInstallCases(t *testing.T, cases []installCase, install func(ctx context.Context, node ertia.Node, opts k3s.InstallOptions) error) {
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("ERTIAKUBE", t.TempDir())
+
+			f := k3stest.NewFakeExecutor()
+			f.Files[nodeTokenPath] = []byte("K10token::server:secret\n")
+			f.Files[kubeconfigPath] = []byte(serverKubeconfig)
+
+			opts := k3s.InstallOptions{
+				Version:  "v1.24.3+k3s1",
+				Endpoint: "k8s.example.com",
+				Config:   k3s.Config{NodeLabels: []string{"pool=web"}},
+				Connect:  f.Connect,
+			}
+			if tc.setup != nil {
+				tc.setup(f, &opts)
+			}
+
+			node := ertia.Node{
+				Name:      "node-1",
+				IPV4:      net.ParseIP("10.0.0.2"),
+				NodeToken: "K10token::server:secret",
+				IsMaster:  true,
+			}
+
+			err := install(context.Background(), node, opts)
+
+			if tc.err != nil {
+				if !errors.Is(err, tc.err) {
+					t.Fatalf("got error %v, want %v", err, tc.err)
+				}
+				if errors.Is(err, k3s.ErrorSSHNotReady) != tc.notReady {
+					t.Fatalf("got error %v, want SSH not ready %v", err, tc.notReady)
+				}
+				var timeout *k3s.TimeoutError
+				if tc.phase != "" && (!errors.As(err, &timeout) || timeout.Phase != tc.phase) {
+					t.Fatalf("got error %v, want a timeout while %s", err, tc.phase)
+				}
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			assertCommands(t, f.Commands, tc.commands)
+
+			if tc.config != "" {
+				config := uploadedConfig(f)
+				if !strings.Contains(config, tc.config) {
+					t.Errorf("config.yaml %q does not contain %q", config, tc.config)
+				}
+			}
+		})
+	}
+}
+
+func assertCommands(t *testing.T, ran, want []string) {
+	t.Helper()
+
+	i := 0
+	for _, cmd := range ran {
+		for i < len(want) && strings.Contains(cmd, want[i]) {
+			i++
+		}
+	}
+	if i < len(want) {
+		t.Errorf("command %q did not run, ran:\n%s", want[i], strings.Join(ran, "\n"))
+	}
+}
+
+func uploadedConfig(f *k3stest.FakeExecutor) string {
+	for path, content := range f.Files {
+		if strings.HasPrefix(path, "/tmp/") && strings.HasSuffix(path, ".yaml") {
+			return string(content)
+		}
+	}
+	return ""
+}
+
+func hangOn(prefix string, timeouts k3s.Timeouts) func(f *k3stest.FakeExecutor, opts *k3s.InstallOptions) {
+	return func(f *k3stest.FakeExecutor, opts *k3s.InstallOptions) {
+		f.Hangs = append(f.Hangs, prefix)
+		opts.Timeouts = timeouts
+	}
+}
+
+func TestInstallK3SServer(t *testing.T) {
+	cases := []installCase{
+		{
+			name: "cluster init",
+			setup: func(f *k3stest.FakeExecutor, opts *k3s.InstallOptions) {
+				opts.ClusterInit = true
+			},
+			commands: []string{
+				"upload /tmp/",
+				"chmod +x /tmp/",
+				"mv /tmp/",
+				"INSTALL_K3S_VERSION=v1.24.3+k3s1 /tmp/",
+				"server --cluster-init",
+				"read " + nodeTokenPath,
+				"read " + kubeconfigPath,
+			},
+			config: "tls-san:\n- k8s.example.com",
+		},
+		{
+			name: "install fails",
+			setup: func(f *k3stest.FakeExecutor, opts *k3s.InstallOptions) {
+				f.Errors["INSTALL_K3S_VERSION="] = errExit
+			},
+			err: errExit,
+		},
+		{
+			name: "token missing",
+			setup: func(f *k3stest.FakeExecutor, opts *k3s.InstallOptions) {
+				delete(f.Files, nodeTokenPath)
+			},
+			err: os.ErrNotExist,
+		},
+		{
+			name: "connect timeout",
+			setup: func(f *k3stest.FakeExecutor, opts *k3s.InstallOptions) {
+				f.ConnectHangs = true
+				opts.Timeouts.Connect = 50 * time.Millisecond
+			},
+			err:      k3s.ErrorTimeout,
+			notReady: true,
+			phase:    k3s.PhaseConnecting,
+		},
+		{
+			name:  "install timeout",
+			setup: hangOn("INSTALL_K3S_VERSION=", k3s.Timeouts{Install: 50 * time.Millisecond}),
+			err:   k3s.ErrorTimeout,
+			phase: k3s.PhaseInstalling,
+		},
+	}
+
+	runInstallCases(t, cases, func(ctx context.Context, node ertia.Node, opts k3s.InstallOptions) error {
+		token, err := k3s.InstallK3SServer(ctx, node, opts)
+		if err == nil && token != "K10token::server:secret\n" {
+			t.Errorf("got token %q", token)
+		}
+		if err == nil {
+			kubeconfig, readErr := os.ReadFile(filepath.Join(os.Getenv("ERTIAKUBE"), "config"))
+			if readErr != nil || !strings.Contains(string(kubeconfig), "https://k8s.example.com:6443") {
+				t.Errorf("kubeconfig does not point at the endpoint: %s %v", kubeconfig, readErr)
+			}
+		}
+		return err
+	})
+}
+
+func TestInstallK3SAgent(t *testing.T) {
+	cases := []installCase{
+		{
+			name: "joins through the endpoint",
+			commands: []string{
+				"upload /tmp/",
+				"chmod +x /tmp/",
+				"mv /tmp/",
+				"INSTALL_K3S_VERSION=v1.24.3+k3s1 K3S_URL=https://k8s.example.com:6443 K3S_TOKEN=K10token::server:secret /tmp/",
+			},
+			config: "node-label:\n- pool=web",
+		},
+		{
+			name: "upload fails",
+			setup: func(f *k3stest.FakeExecutor, opts *k3s.InstallOptions) {
+				f.Errors["upload /tmp/"] = errExit
+			},
+			err: errExit,
+		},
+		{
+			name:  "upload timeout",
+			setup: hangOn("upload /tmp/", k3s.Timeouts{Upload: 50 * time.Millisecond}),
+			err:   k3s.ErrorTimeout,
+			phase: k3s.PhaseUploading,
+		},
+	}
+
+	runInstallCases(t, cases, func(ctx context.Context, node ertia.Node, opts k3s.InstallOptions) error {
+		node.IsMaster = false
+		return k3s.InstallK3SAgent(ctx, node, opts.Endpoint, opts)
+	})
+}
+
+func TestJoinK3SServer(t *testing.T) {
+	cases := []installCase{
+		{
+			name: "joins as server",
+			commands: []string{
+				"upload /tmp/",
+				"mv /tmp/",
+				"K3S_URL=https://10.0.0.1:6443 K3S_TOKEN=K10token::server:secret /tmp/",
+			},
+			config: "tls-san:\n- k8s.example.com",
+		},
+		{
+			name: "install fails",
+			setup: func(f *k3stest.FakeExecutor, opts *k3s.InstallOptions) {
+				f.Errors["INSTALL_K3S_VERSION="] = errExit
+			},
+			err: errExit,
+		},
+		{
+			name:  "install timeout",
+			setup: hangOn("INSTALL_K3S_VERSION=", k3s.Timeouts{Install: 50 * time.Millisecond}),
+			err:   k3s.ErrorTimeout,
+			phase: k3s.PhaseInstalling,
+		},
+	}
+
+	runInstallCases(t, cases, func(ctx context.Context, node ertia.Node, opts k3s.InstallOptions) error {
+		return k3s.JoinK3SServer(ctx, node, "10.0.0.1", opts)
+	})
+}
+
+func TestInstallProgress(t *testing.T) {
+	cases := []struct {
+		name   string
+		buffer int
+		fail   bool
+
+		// phases are expected in this order, none when the subscriber is
+		// not ready.
+		phases []k3s.Phase
+	}{
+		{
+			name:   "phases in order",
+			buffer: 10,
+			phases: []k3s.Phase{k3s.PhaseConnecting, k3s.PhaseUploading, k3s.PhaseInstalling, k3s.PhaseDone},
+		},
+		{
+			name:   "failure",
+			buffer: 10,
+			fail:   true,
+			phases: []k3s.Phase{k3s.PhaseConnecting, k3s.PhaseUploading, k3s.PhaseInstalling, k3s.PhaseFailed},
+		},
+		{
+			name: "subscriber not ready",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			f := k3stest.NewFakeExecutor()
+			if tc.fail {
+				f.Errors["INSTALL_K3S_VERSION="] = errExit
+			}
+
+			progress := make(chan k3s.Progress, tc.buffer)
+			opts := k3s.InstallOptions{Version: "v1.24.3+k3s1", Connect: f.Connect, Progress: progress}
+
+			node := ertia.Node{Name: "node-1", NodeToken: "K10token::server:secret"}
+			err := k3s.InstallK3SAgent(context.Background(), node, "10.0.0.1", opts)
+			if (err != nil) != tc.fail {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			close(progress)
+
+			var phases []k3s.Phase
+			for p := range progress {
+				if p.Node != node.Name || (p.Phase == k3s.PhaseFailed) != (p.Err != nil) {
+					t.Errorf("unexpected event %+v", p)
+				}
+				phases = append(phases, p.Phase)
+			}
+			if len(phases) != len(tc.phases) {
+				t.Fatalf("got phases %v, want %v", phases, tc.phases)
+			}
+			for i := range phases {
+				if phases[i] != tc.phases[i] {
+					t.Fatalf("got phases %v, want %v", phases, tc.phases)
+				}
+			}
+		})
+	}
+}
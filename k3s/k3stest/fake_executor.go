@@ -0,0 +1,173 @@
+// Package k3stest provides an in-memory k3s.Executor for testing installs
+// without nodes.
+package k3stest
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	ertia "github.com/ertia-io/config/pkg/entities"
+	"github.com/ertia-io/providers/k3s"
+)
+
+// FakeExecutor is an in-memory k3s.Executor that records what the installer does
+// instead of touching a node. Commands are answered from Outputs and Errors
+// by the longest key they start with.
+type FakeExecutor struct {
+	mu sync.Mutex
+
+	// Files holds uploaded files and files the installer may read.
+	Files map[string][]byte
+
+	// Commands lists every command run, uploads as "upload <path>" and
+	// reads as "read <path>".
+	Commands []string
+
+	Outputs map[string][]byte
+	Errors  map[string]error
+
+	// Hangs lists command prefixes that block until the context is done,
+	// to run into timeouts.
+	Hangs []string
+
+	// ConnectErr is returned by Connect instead of the executor.
+	ConnectErr error
+
+	// ConnectHangs makes Connect block until the context is done.
+	ConnectHangs bool
+}
+
+// NewFakeExecutor returns an empty FakeExecutor.
+func NewFakeExecutor() *FakeExecutor {
+	return &FakeExecutor{
+		Files:   map[string][]byte{},
+		Outputs: map[string][]byte{},
+		Errors:  map[string]error{},
+	}
+}
+
+// Connect is a k3s.Connector handing out the fake for every node.
+func (f *FakeExecutor) Connect(ctx context.Context, _ ertia.Node) (k3s.Executor, error) {
+	if f.ConnectHangs {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	if f.ConnectErr != nil {
+		return nil, f.ConnectErr
+	}
+	return f, nil
+}
+
+func (f *FakeExecutor) Upload(ctx context.Context, path string, content []byte) error {
+	if err := f.hang(ctx, "upload "+path); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.Files[path] = append([]byte{}, content...)
+	return f.errorFor("upload " + path)
+}
+
+func (f *FakeExecutor) RunEscalated(ctx context.Context, cmd string) ([]byte, error) {
+	if err := f.hang(ctx, cmd); err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.outputFor(cmd), f.errorFor(cmd)
+}
+
+func (f *FakeExecutor) RunEscalatedStream(ctx context.Context, cmd string, onLine func(stream, line string)) ([]byte, error) {
+	out, err := f.RunEscalated(ctx, cmd)
+	if onLine != nil && len(out) > 0 {
+		for _, line := range strings.Split(strings.TrimRight(string(out), "\n"), "\n") {
+			onLine("stdout", line)
+		}
+	}
+	return out, err
+}
+
+func (f *FakeExecutor) ReadFile(ctx context.Context, path string) ([]byte, error) {
+	if err := f.hang(ctx, "read "+path); err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.errorFor("read " + path); err != nil {
+		return nil, err
+	}
+
+	content, ok := f.Files[path]
+	if !ok {
+		return nil, fmt.Errorf("reading %s: %w", path, os.ErrNotExist)
+	}
+	return content, nil
+}
+
+func (f *FakeExecutor) Close() error {
+	return nil
+}
+
+// Ran tells whether a command starting with prefix was run.
+func (f *FakeExecutor) Ran(prefix string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, cmd := range f.Commands {
+		if strings.HasPrefix(cmd, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// hang records the command and blocks until ctx is done when it matches
+// Hangs.
+func (f *FakeExecutor) hang(ctx context.Context, cmd string) error {
+	f.mu.Lock()
+	f.Commands = append(f.Commands, cmd)
+	hangs := false
+	for _, prefix := range f.Hangs {
+		if strings.HasPrefix(cmd, prefix) {
+			hangs = true
+		}
+	}
+	f.mu.Unlock()
+
+	if !hangs {
+		return nil
+	}
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (f *FakeExecutor) outputFor(cmd string) []byte {
+	var out []byte
+	match := -1
+	for prefix, o := range f.Outputs {
+		if strings.HasPrefix(cmd, prefix) && len(prefix) > match {
+			out, match = o, len(prefix)
+		}
+	}
+	return out
+}
+
+func (f *FakeExecutor) errorFor(cmd string) error {
+	var err error
+	match := -1
+	for prefix, e := range f.Errors {
+		if strings.HasPrefix(cmd, prefix) && len(prefix) > match {
+			err, match = e, len(prefix)
+		}
+	}
+	return err
+}
@@ -0,0 +1,236 @@
+package k3s
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ertia-io/config/pkg/config"
+	"gopkg.in/yaml.v2"
+)
+
+// k3s names the cluster, context and user of its kubeconfig "default".
+const k3sKubeconfigName = "default"
+
+// KubeconfigOptions configure where the kubeconfig of a cluster is written.
+type KubeconfigOptions struct {
+	// Name replaces "default" as cluster, context and user name, usually
+	// the project name.
+	Name string
+
+	// ID, usually the project ID, keeps the kubeconfigs of projects with
+	// the same name apart. The kubeconfig is written to <id>-<name>.yaml in
+	// the ertia kube directory, with anything but letters, digits, '.', '-'
+	// and '_' in either replaced. Without ID and name it overwrites the
+	// ertia kube config as before.
+	ID string
+
+	// MergeInto is a kubeconfig, e.g. ~/.kube/config, the cluster is added
+	// to as well.
+	MergeInto string
+}
+
+// Path returns the file the kubeconfig of the cluster is written to.
+func (o KubeconfigOptions) Path() string {
+	if o.ID == "" && o.Name == "" {
+		return config.ErtiaKubeConfigPath()
+	}
+
+	var parts []string
+	for _, part := range []string{o.ID, o.Name} {
+		if part = fileNamePart(part); part != "" {
+			parts = append(parts, part)
+		}
+	}
+	if len(parts) == 0 {
+		parts = append(parts, k3sKubeconfigName)
+	}
+
+	return filepath.Join(config.ErtiaKubePath(), strings.Join(parts, "-")+".yaml")
+}
+
+// fileNamePart makes s safe to use in a file name, it can neither leave the
+// directory nor hide the file.
+func fileNamePart(s string) string {
+	s = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+			return r
+		}
+		return '_'
+	}, s)
+	return strings.TrimLeft(s, ".")
+}
+
+type kubeconfig struct {
+	APIVersion     string                 `yaml:"apiVersion"`
+	Kind           string                 `yaml:"kind"`
+	Clusters       []kubeconfigEntry      `yaml:"clusters"`
+	Contexts       []kubeconfigEntry      `yaml:"contexts"`
+	Users          []kubeconfigEntry      `yaml:"users"`
+	CurrentContext string                 `yaml:"current-context"`
+	Extra          map[string]interface{} `yaml:",inline"`
+}
+
+type kubeconfigEntry struct {
+	Name    string                 `yaml:"name"`
+	Cluster map[string]interface{} `yaml:"cluster,omitempty"`
+	Context map[string]interface{} `yaml:"context,omitempty"`
+	User    map[string]interface{} `yaml:"user,omitempty"`
+}
+
+// WriteKubeconfig writes the kubeconfig fetched from a k3s server, pointed
+// at endpoint and renamed after o.Name, and merges it into o.MergeInto.
+func WriteKubeconfig(raw []byte, endpoint string, o KubeconfigOptions) error {
+	var kc kubeconfig
+	err := yaml.Unmarshal(raw, &kc)
+	if err != nil {
+		return fmt.Errorf("parsing kubeconfig: %w", err)
+	}
+
+	name := o.Name
+	if name == "" {
+		name = k3sKubeconfigName
+	}
+
+	for i := range kc.Clusters {
+		if kc.Clusters[i].Name != k3sKubeconfigName {
+			continue
+		}
+		kc.Clusters[i].Name = name
+		if server, ok := kc.Clusters[i].Cluster["server"].(string); ok {
+			kc.Clusters[i].Cluster["server"] = strings.ReplaceAll(server, "127.0.0.1", endpoint)
+		}
+	}
+	for i := range kc.Contexts {
+		if kc.Contexts[i].Name != k3sKubeconfigName {
+			continue
+		}
+		kc.Contexts[i].Name = name
+		kc.Contexts[i].Context["cluster"] = name
+		kc.Contexts[i].Context["user"] = name
+	}
+	for i := range kc.Users {
+		if kc.Users[i].Name == k3sKubeconfigName {
+			kc.Users[i].Name = name
+		}
+	}
+	kc.CurrentContext = name
+
+	err = writeKubeconfig(o.Path(), &kc)
+	if err != nil {
+		return err
+	}
+
+	if o.MergeInto == "" {
+		return nil
+	}
+
+	existing, err := readKubeconfig(o.MergeInto)
+	if err != nil {
+		return err
+	}
+
+	existing.remove(name)
+	existing.Clusters = append(existing.Clusters, kc.Clusters...)
+	existing.Contexts = append(existing.Contexts, kc.Contexts...)
+	existing.Users = append(existing.Users, kc.Users...)
+	if existing.CurrentContext == "" {
+		existing.CurrentContext = name
+	}
+
+	return writeKubeconfig(o.MergeInto, existing)
+}
+
+// RemoveKubeconfig deletes the kubeconfig of the cluster and removes its
+// cluster, context and user from o.MergeInto.
+func RemoveKubeconfig(o KubeconfigOptions) error {
+	err := os.Remove(o.Path())
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	if o.MergeInto == "" || o.Name == "" {
+		return nil
+	}
+
+	existing, err := readKubeconfig(o.MergeInto)
+	if err != nil {
+		return err
+	}
+
+	existing.remove(o.Name)
+	if existing.CurrentContext == o.Name {
+		existing.CurrentContext = ""
+	}
+
+	return writeKubeconfig(o.MergeInto, existing)
+}
+
+func (kc *kubeconfig) remove(name string) {
+	kc.Clusters = withoutEntry(kc.Clusters, name)
+	kc.Contexts = withoutEntry(kc.Contexts, name)
+	kc.Users = withoutEntry(kc.Users, name)
+}
+
+func withoutEntry(entries []kubeconfigEntry, name string) []kubeconfigEntry {
+	out := make([]kubeconfigEntry, 0, len(entries))
+	for _, e := range entries {
+		if e.Name != name {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// readKubeconfig reads the kubeconfig at path, a missing file is empty.
+func readKubeconfig(path string) (*kubeconfig, error) {
+	kc := &kubeconfig{APIVersion: "v1", Kind: "Config"}
+
+	raw, err := ioutil.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return kc, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = yaml.Unmarshal(raw, kc)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return kc, nil
+}
+
+// writeKubeconfig replaces the file at path, which is only readable by the
+// owner since it holds credentials.
+func writeKubeconfig(path string, kc *kubeconfig) error {
+	out, err := yaml.Marshal(kc)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(out)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,185 @@
+package k3s_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ertia-io/providers/k3s"
+	"gopkg.in/yaml.v2"
+)
+
+const otherKubeconfig = `apiVersion: v1
+kind: Config
+clusters:
+- name: other
+  cluster:
+    server: https://192.0.2.9:6443
+contexts:
+- name: other
+  context:
+    cluster: other
+    user: other
+users:
+- name: other
+  user:
+    token: other
+current-context: other
+`
+
+func TestKubeconfigPath(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("ERTIAKUBE", dir)
+
+	cases := []struct {
+		name string
+		o    k3s.KubeconfigOptions
+		want string
+	}{
+		{name: "id and name", o: k3s.KubeconfigOptions{ID: "2FKq", Name: "web"}, want: "2FKq-web.yaml"},
+		{name: "same name, other id", o: k3s.KubeconfigOptions{ID: "2FKr", Name: "web"}, want: "2FKr-web.yaml"},
+		{name: "id only", o: k3s.KubeconfigOptions{ID: "2FKq"}, want: "2FKq.yaml"},
+		{name: "name leaving the directory", o: k3s.KubeconfigOptions{ID: "2FKq", Name: "../../etc/passwd"}, want: "2FKq-_.._etc_passwd.yaml"},
+		{name: "hidden name", o: k3s.KubeconfigOptions{Name: ".."}, want: "default.yaml"},
+		{name: "spaces", o: k3s.KubeconfigOptions{Name: "my project"}, want: "my_project.yaml"},
+		{name: "neither", o: k3s.KubeconfigOptions{}, want: "config"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.o.Path(); got != filepath.Join(dir, tc.want) {
+				t.Errorf("got path %s, want %s in %s", got, tc.want, dir)
+			}
+		})
+	}
+}
+
+// readContexts returns the context names of the kubeconfig at path and its
+// current context.
+func readContexts(t *testing.T, path string) ([]string, string) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var kc struct {
+		Contexts []struct {
+			Name string `yaml:"name"`
+		} `yaml:"contexts"`
+		CurrentContext string `yaml:"current-context"`
+	}
+	err = yaml.Unmarshal(raw, &kc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, c := range kc.Contexts {
+		names = append(names, c.Name)
+	}
+	return names, kc.CurrentContext
+}
+
+func TestWriteKubeconfig(t *testing.T) {
+	cases := []struct {
+		name     string
+		existing string
+
+		contexts []string
+		current  string
+	}{
+		{name: "new file", contexts: []string{"web"}, current: "web"},
+		{name: "merged into existing", existing: otherKubeconfig, contexts: []string{"other", "web"}, current: "other"},
+		{name: "replaces earlier write", existing: strings.ReplaceAll(otherKubeconfig, "other", "web"), contexts: []string{"web"}, current: "web"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("ERTIAKUBE", t.TempDir())
+
+			mergeInto := filepath.Join(t.TempDir(), "config")
+			if tc.existing != "" {
+				if err := os.WriteFile(mergeInto, []byte(tc.existing), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			o := k3s.KubeconfigOptions{ID: "2FKq", Name: "web", MergeInto: mergeInto}
+			err := k3s.WriteKubeconfig([]byte(serverKubeconfig), "k8s.example.com", o)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			raw, err := os.ReadFile(o.Path())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(raw), "https://k8s.example.com:6443") || strings.Contains(string(raw), "default") {
+				t.Errorf("kubeconfig not pointed at the endpoint and renamed:\n%s", raw)
+			}
+			if info, err := os.Stat(o.Path()); err != nil || info.Mode().Perm() != 0600 {
+				t.Errorf("kubeconfig mode %v, want 0600", info.Mode())
+			}
+
+			contexts, current := readContexts(t, mergeInto)
+			if strings.Join(contexts, ",") != strings.Join(tc.contexts, ",") || current != tc.current {
+				t.Errorf("merged contexts %v current %q, want %v current %q", contexts, current, tc.contexts, tc.current)
+			}
+		})
+	}
+}
+
+func TestRemoveKubeconfig(t *testing.T) {
+	cases := []struct {
+		name    string
+		written bool
+
+		contexts []string
+		current  string
+	}{
+		{name: "written", written: true, contexts: []string{"other"}, current: "other"},
+		{name: "never written", contexts: []string{"other"}, current: "other"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("ERTIAKUBE", t.TempDir())
+
+			mergeInto := filepath.Join(t.TempDir(), "config")
+			if err := os.WriteFile(mergeInto, []byte(otherKubeconfig), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			o := k3s.KubeconfigOptions{ID: "2FKq", Name: "web", MergeInto: mergeInto}
+			if tc.written {
+				if err := k3s.WriteKubeconfig([]byte(serverKubeconfig), "k8s.example.com", o); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// Another project of the same name keeps its kubeconfig.
+			same := k3s.KubeconfigOptions{ID: "2FKr", Name: "web"}
+			if err := k3s.WriteKubeconfig([]byte(serverKubeconfig), "k8s.example.org", same); err != nil {
+				t.Fatal(err)
+			}
+
+			err := k3s.RemoveKubeconfig(o)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if _, err := os.Stat(o.Path()); !os.IsNotExist(err) {
+				t.Errorf("kubeconfig %s still there: %v", o.Path(), err)
+			}
+			if _, err := os.Stat(same.Path()); err != nil {
+				t.Errorf("kubeconfig of the other project removed: %v", err)
+			}
+
+			contexts, current := readContexts(t, mergeInto)
+			if strings.Join(contexts, ",") != strings.Join(tc.contexts, ",") || current != tc.current {
+				t.Errorf("merged contexts %v current %q, want %v current %q", contexts, current, tc.contexts, tc.current)
+			}
+		})
+	}
+}
@@ -0,0 +1,259 @@
+package k3s
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	ertia "github.com/ertia-io/config/pkg/entities"
+	"github.com/rs/zerolog/log"
+	"github.com/segmentio/ksuid"
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	ErrorNodeNotReady = errors.New("K3S.NodeNotReady")
+)
+
+const nodePollInterval = 5 * time.Second
+
+// Kubectl runs kubectl through k3s on a server node.
+func Kubectl(ctx context.Context, connect Connector, server ertia.Node, args ...string) ([]byte, error) {
+	exec, err := connect(ctx, server)
+	if err != nil {
+		return nil, err
+	}
+	defer exec.Close()
+
+	quoted := make([]string, 0, len(args))
+	for _, arg := range args {
+		quoted = append(quoted, shellQuote(arg))
+	}
+
+	out, err := exec.RunEscalated(ctx, "k3s kubectl "+strings.Join(quoted, " "))
+	if err != nil {
+		return out, fmt.Errorf("kubectl %s: %w: %s", strings.Join(args, " "), err, remoteOutput(out))
+	}
+
+	return out, nil
+}
+
+// WaitForNodeReady waits until the named node reports the Ready condition.
+func WaitForNodeReady(ctx context.Context, connect Connector, server ertia.Node, nodeName string, timeout time.Duration) error {
+	return WaitForNodeVersion(ctx, connect, server, nodeName, "", timeout)
+}
+
+// WaitForNodeVersion waits until the named node is Ready and its kubelet
+// reports version. An empty version accepts any.
+func WaitForNodeVersion(ctx context.Context, connect Connector, server ertia.Node, nodeName, version string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+
+	status, running := "", ""
+	for {
+		out, err := Kubectl(ctx, connect, server, "get", "node", nodeName, "-o", `jsonpath={.status.conditions[?(@.type=="Ready")].status} {.status.nodeInfo.kubeletVersion}`)
+		if err == nil {
+			status, running = "", ""
+			fields := strings.Fields(string(out))
+			if len(fields) > 0 {
+				status = fields[0]
+			}
+			if len(fields) > 1 {
+				running = fields[1]
+			}
+			if status == "True" && (version == "" || running == version) {
+				return nil
+			}
+		} else {
+			log.Ctx(ctx).Debug().Err(err).Str("node", nodeName).Msg("Node not registered yet")
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%w: %s (Ready=%q, version=%q)", ErrorNodeNotReady, nodeName, status, running)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(nodePollInterval):
+		}
+	}
+}
+
+// WaitForReady waits until the named node is Ready and every pod in
+// kube-system is running or completed. When the timeout expires the error
+// carries the last condition observed.
+func WaitForReady(ctx context.Context, connect Connector, server ertia.Node, nodeName string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+
+	last := "node not registered"
+	for {
+		ready, condition, err := nodeReadyCondition(ctx, connect, server, nodeName)
+		switch {
+		case err != nil:
+			log.Ctx(ctx).Debug().Err(err).Str("node", nodeName).Msg("Node not registered yet")
+		case !ready:
+			last = condition
+		default:
+			pending, err := pendingSystemPods(ctx, connect, server)
+			if err == nil && len(pending) == 0 {
+				return nil
+			}
+			if err != nil {
+				last = err.Error()
+			} else {
+				last = "system pods not running: " + strings.Join(pending, ", ")
+			}
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%w: %s: %s", ErrorNodeNotReady, nodeName, last)
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w: %s: %s", ctx.Err(), nodeName, last)
+		case <-time.After(nodePollInterval):
+		}
+	}
+}
+
+// nodeReadyCondition returns whether the node is Ready and a description of
+// its Ready condition.
+func nodeReadyCondition(ctx context.Context, connect Connector, server ertia.Node, nodeName string) (bool, string, error) {
+	out, err := Kubectl(ctx, connect, server, "get", "node", nodeName, "-o",
+		`jsonpath={.status.conditions[?(@.type=="Ready")].status}|{.status.conditions[?(@.type=="Ready")].reason}|{.status.conditions[?(@.type=="Ready")].message}`)
+	if err != nil {
+		return false, "", err
+	}
+
+	parts := strings.SplitN(strings.TrimSpace(string(out)), "|", 3)
+	for len(parts) < 3 {
+		parts = append(parts, "")
+	}
+
+	return parts[0] == "True", fmt.Sprintf("Ready=%s %s: %s", parts[0], parts[1], parts[2]), nil
+}
+
+// pendingSystemPods lists the kube-system pods that are not running with all
+// containers ready, as name=phase. Completed pods and pods of jobs, such as
+// the helm installs that keep their failed attempts around, are left out.
+func pendingSystemPods(ctx context.Context, connect Connector, server ertia.Node) ([]string, error) {
+	out, err := Kubectl(ctx, connect, server, "get", "pods", "-n", "kube-system", "-o",
+		`jsonpath={range .items[*]}{.metadata.name}|{.status.phase}|{.metadata.ownerReferences[*].kind}|{.status.containerStatuses[*].ready}{"\n"}{end}`)
+	if err != nil {
+		return nil, err
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	if len(lines) == 1 && lines[0] == "" {
+		return []string{"none scheduled yet"}, nil
+	}
+
+	var pending []string
+	for _, line := range lines {
+		parts := strings.SplitN(line, "|", 4)
+		for len(parts) < 4 {
+			parts = append(parts, "")
+		}
+		name, phase, owners, ready := parts[0], parts[1], strings.Fields(parts[2]), strings.Fields(parts[3])
+
+		switch {
+		case phase == "Succeeded" || contains(owners, "Job"):
+			continue
+		case phase == "Running" && len(ready) > 0 && !contains(ready, "false"):
+			continue
+		case phase == "Running":
+			phase = "NotReady"
+		}
+		pending = append(pending, name+"="+phase)
+	}
+	return pending, nil
+}
+
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// DrainNode cordons the named node and evicts its pods. Evictions go through
+// the eviction API, so PodDisruptionBudgets are respected until the timeout.
+func DrainNode(ctx context.Context, connect Connector, server ertia.Node, nodeName string, timeout time.Duration) error {
+	_, err := Kubectl(ctx, connect, server, "cordon", nodeName)
+	if err != nil {
+		return err
+	}
+
+	_, err = Kubectl(ctx, connect, server, "drain", nodeName,
+		"--ignore-daemonsets",
+		"--delete-emptydir-data",
+		fmt.Sprintf("--timeout=%ds", int(timeout.Seconds())),
+	)
+	return err
+}
+
+// UncordonNode marks the named node as schedulable.
+func UncordonNode(ctx context.Context, connect Connector, server ertia.Node, nodeName string) error {
+	_, err := Kubectl(ctx, connect, server, "uncordon", nodeName)
+	return err
+}
+
+// RemoveNode deletes the named node object from the cluster. For servers k3s
+// holds the deletion with a finalizer until the etcd member of the node is
+// removed, kubectl waits for that.
+func RemoveNode(ctx context.Context, connect Connector, server ertia.Node, nodeName string) error {
+	_, err := Kubectl(ctx, connect, server, "delete", "node", nodeName, "--ignore-not-found")
+	return err
+}
+
+// ApplySecret creates or updates the secret through the server. The data is
+// uploaded rather than passed on the command line, so it stays out of
+// process listings and logs.
+func ApplySecret(ctx context.Context, connect Connector, server ertia.Node, namespace, name string, data map[string]string) error {
+	manifest, err := yaml.Marshal(map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Secret",
+		"type":       "Opaque",
+		"metadata":   map[string]string{"name": name, "namespace": namespace},
+		"stringData": data,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = applyManifest(ctx, connect, server, manifest)
+	return err
+}
+
+// applyManifest applies the manifest with kubectl on the server and tells
+// whether it changed anything.
+func applyManifest(ctx context.Context, connect Connector, server ertia.Node, manifest []byte) (bool, error) {
+	exec, err := connect(ctx, server)
+	if err != nil {
+		return false, err
+	}
+	defer exec.Close()
+
+	path := "/tmp/" + ksuid.New().String() + ".yaml"
+	err = exec.Upload(ctx, path, manifest)
+	if err != nil {
+		return false, err
+	}
+
+	out, err := exec.RunEscalated(ctx, fmt.Sprintf("k3s kubectl apply -f %s", path))
+	exec.RunEscalated(ctx, fmt.Sprintf("rm -f %s", path))
+	if err != nil {
+		return false, fmt.Errorf("kubectl apply: %w: %s", err, remoteOutput(out))
+	}
+
+	return !strings.Contains(string(out), " unchanged"), nil
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'"'"'`) + "'"
+}
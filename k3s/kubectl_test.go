@@ -0,0 +1,74 @@
+package k3s_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	ertia "github.com/ertia-io/config/pkg/entities"
+	"github.com/ertia-io/providers/k3s"
+	"github.com/ertia-io/providers/k3s/k3stest"
+)
+
+func TestWaitForReady(t *testing.T) {
+	cases := []struct {
+		name string
+		pods string
+
+		// pending is expected in the error, none when empty.
+		pending string
+	}{
+		{
+			name: "ready",
+			pods: "coredns-1|Running|ReplicaSet|true\n" +
+				"svclb-traefik-1|Running|DaemonSet|true true\n" +
+				"helm-install-traefik-1|Succeeded|Job|false\n",
+		},
+		{
+			name: "failed helm install attempts",
+			pods: "coredns-1|Running|ReplicaSet|true\n" +
+				"helm-install-traefik-1|Failed|Job|false\n" +
+				"helm-install-traefik-2|Succeeded|Job|false\n",
+		},
+		{
+			name:    "container not ready",
+			pods:    "coredns-1|Running|ReplicaSet|false\n",
+			pending: "coredns-1=NotReady",
+		},
+		{
+			name:    "one of the containers not ready",
+			pods:    "svclb-traefik-1|Running|DaemonSet|true false\n",
+			pending: "svclb-traefik-1=NotReady",
+		},
+		{
+			name:    "pending",
+			pods:    "metrics-server-1|Pending|ReplicaSet|\n",
+			pending: "metrics-server-1=Pending",
+		},
+		{
+			name:    "none scheduled",
+			pending: "none scheduled yet",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			f := k3stest.NewFakeExecutor()
+			f.Outputs["k3s kubectl 'get' 'node'"] = []byte("True|KubeletReady|kubelet is posting ready status")
+			f.Outputs["k3s kubectl 'get' 'pods'"] = []byte(tc.pods)
+
+			err := k3s.WaitForReady(context.Background(), f.Connect, ertia.Node{Name: "server"}, "node-1", 0)
+
+			if tc.pending == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, k3s.ErrorNodeNotReady) || !strings.Contains(err.Error(), tc.pending) {
+				t.Fatalf("got error %v, want %s pending", err, tc.pending)
+			}
+		})
+	}
+}
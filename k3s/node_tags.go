@@ -0,0 +1,181 @@
+package k3s
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	ertia "github.com/ertia-io/config/pkg/entities"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	ErrorReservedTag = errors.New("K3S.ReservedTag")
+)
+
+// StateTagPrefix is reserved for the state the installer keeps about nodes
+// and the cluster. It is stored as node and project tags so it travels with
+// the project, user tags must not use it.
+const StateTagPrefix = "ertia.state/"
+
+const (
+	versionTag   = StateTagPrefix + "k3s-version:"
+	hostKeyTag   = StateTagPrefix + "ssh-host-key:"
+	privateIPTag = StateTagPrefix + "private-ipv4:"
+
+	// clusterInitTag marks the server the cluster is initialised on. It is
+	// set before the install starts, so while the server is still coming up
+	// no other server initialises a second cluster.
+	clusterInitTag = StateTagPrefix + "cluster-init:"
+
+	// helmChartTag is a project tag followed by the chart name, =, and its
+	// hash.
+	helmChartTag = StateTagPrefix + "helm-chart:"
+)
+
+// IsStateTag tells whether the tag holds installer state.
+func IsStateTag(tag string) bool {
+	return strings.HasPrefix(tag, StateTagPrefix)
+}
+
+// CheckUserTags refuses tags using the reserved StateTagPrefix, for nodes
+// that are about to be created.
+func CheckUserTags(tags []string) error {
+	for _, tag := range tags {
+		if IsStateTag(tag) {
+			return fmt.Errorf("%w: %s, %s is reserved", ErrorReservedTag, tag, StateTagPrefix)
+		}
+	}
+	return nil
+}
+
+// NodeVersion returns the k3s version recorded for the node.
+func NodeVersion(node *ertia.Node) string {
+	return nodeTag(node, versionTag)
+}
+
+// SetNodeVersion records the k3s version running on the node.
+func SetNodeVersion(node *ertia.Node, version string) {
+	setNodeTag(node, versionTag, version)
+}
+
+// RecordVersion asks the node which version it runs and records it. Failures
+// are only logged, the install itself has already succeeded.
+func RecordVersion(ctx context.Context, connect Connector, node *ertia.Node) {
+	version, err := InstalledVersion(ctx, connect, *node)
+	if err != nil {
+		log.Ctx(ctx).Warn().Err(err).Str("node", node.Name).Msg("Could not read k3s version")
+		return
+	}
+	SetNodeVersion(node, version)
+}
+
+// IsInitServer tells whether the cluster is initialised on the node.
+func IsInitServer(node *ertia.Node) bool {
+	return nodeTag(node, clusterInitTag) == "true"
+}
+
+// SetInitServer records that the cluster is initialised on the node.
+func SetInitServer(node *ertia.Node) {
+	setNodeTag(node, clusterInitTag, "true")
+}
+
+// InitServer returns the server the cluster is initialised on, nil when no
+// server has started initialising it or that server is deleted.
+func InitServer(cfg *ertia.Project) *ertia.Node {
+	for i := range cfg.Nodes {
+		n := &cfg.Nodes[i]
+		if n.IsMaster && n.Status != ertia.NodeStatusDeleted && IsInitServer(n) {
+			return n
+		}
+	}
+	return nil
+}
+
+// NodePrivateIP returns the address of the node in the private network of
+// the project, nil when it has none.
+func NodePrivateIP(node *ertia.Node) net.IP {
+	return net.ParseIP(nodeTag(node, privateIPTag))
+}
+
+// SetNodePrivateIP records the address of the node in the private network of
+// the project. Nodes behind a bastion are reached at it.
+func SetNodePrivateIP(node *ertia.Node, ip net.IP) {
+	value := ""
+	if ip != nil {
+		value = ip.String()
+	}
+	setNodeTag(node, privateIPTag, value)
+}
+
+// ProjectHelmChart returns the hash of the chart last installed into the
+// cluster.
+func ProjectHelmChart(cfg *ertia.Project, name string) string {
+	return findTag(cfg.Tags, helmChartTag+name+"=")
+}
+
+// SetProjectHelmChart records the hash of the chart installed into the
+// cluster. It is kept on the project rather than the server it was installed
+// through, so it survives replacing that server.
+func SetProjectHelmChart(cfg *ertia.Project, name, hash string) {
+	cfg.Tags = withTag(cfg.Tags, helmChartTag+name+"=", hash)
+}
+
+// ClusterVersion returns the version recorded on the first server that has
+// one, so nodes added later can be installed with the same version.
+func ClusterVersion(cfg *ertia.Project) string {
+	for i := range cfg.Nodes {
+		if cfg.Nodes[i].IsMaster {
+			if v := NodeVersion(&cfg.Nodes[i]); v != "" {
+				return v
+			}
+		}
+	}
+	return ""
+}
+
+// WithoutNodeState returns tags without the state recorded by the installer,
+// for a new node taking over the tags of another.
+func WithoutNodeState(tags []string) []string {
+	out := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		if !IsStateTag(tag) {
+			out = append(out, tag)
+		}
+	}
+	return out
+}
+
+func nodeTag(node *ertia.Node, prefix string) string {
+	return findTag(node.Tags, prefix)
+}
+
+func setNodeTag(node *ertia.Node, prefix, value string) {
+	node.Tags = withTag(node.Tags, prefix, value)
+}
+
+func findTag(tags []string, prefix string) string {
+	for _, tag := range tags {
+		if strings.HasPrefix(tag, prefix) {
+			return strings.TrimPrefix(tag, prefix)
+		}
+	}
+	return ""
+}
+
+// withTag returns tags with the tag of prefix set to value, or removed when
+// value is empty.
+func withTag(tags []string, prefix, value string) []string {
+	out := make([]string, 0, len(tags)+1)
+	for _, tag := range tags {
+		if !strings.HasPrefix(tag, prefix) {
+			out = append(out, tag)
+		}
+	}
+	if value != "" {
+		out = append(out, prefix+value)
+	}
+	return out
+}
@@ -0,0 +1,65 @@
+package k3s
+
+import (
+	"context"
+	"time"
+
+	"github.com/ertia-io/providers/redact"
+	"github.com/rs/zerolog/log"
+)
+
+// Phase is a step of installing k3s on a node.
+type Phase string
+
+const (
+	PhaseConnecting         Phase = "connecting"
+	PhaseUploading          Phase = "uploading"
+	PhaseInstalling         Phase = "installing"
+	PhaseFetchingToken      Phase = "fetching token"
+	PhaseFetchingKubeconfig Phase = "fetching kubeconfig"
+	PhaseDone               Phase = "done"
+	PhaseFailed             Phase = "failed"
+)
+
+// Progress is sent on InstallOptions.Progress as an install moves through
+// its phases.
+type Progress struct {
+	Node  string
+	Phase Phase
+	Time  time.Time
+
+	// Err is set with PhaseFailed.
+	Err error
+}
+
+// progress logs the phase and sends it to the subscriber, if any. The send
+// never blocks the install, events the subscriber is not ready for are
+// dropped.
+func (o InstallOptions) progress(ctx context.Context, node string, phase Phase, err error) {
+	event := log.Ctx(ctx).Info()
+	if err != nil {
+		event = log.Ctx(ctx).Error().Err(err)
+	}
+	event.Str("node", node).Str("phase", string(phase)).Msg("K3S install")
+
+	if o.Progress == nil {
+		return
+	}
+
+	select {
+	case o.Progress <- Progress{Node: node, Phase: phase, Time: time.Now(), Err: err}:
+	default:
+		log.Ctx(ctx).Debug().Str("node", node).Str("phase", string(phase)).Msg("Dropped K3S install progress")
+	}
+}
+
+// logLines returns an onLine func logging installer output for the node.
+func logLines(ctx context.Context, node string, phase Phase) func(stream, line string) {
+	return func(stream, line string) {
+		log.Ctx(ctx).Info().
+			Str("node", node).
+			Str("phase", string(phase)).
+			Str("stream", stream).
+			Msg(redact.String(line))
+	}
+}
@@ -0,0 +1,384 @@
+package k3s
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ertia-io/config/pkg/config"
+	ertia "github.com/ertia-io/config/pkg/entities"
+	"github.com/ertia-io/providers/redact"
+	"github.com/fabled-se/goph"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/ssh"
+)
+
+// Project tags configuring how nodes of the project are reached.
+const (
+	// ssh-bastion:[user@]host[:port], "master" jumps through a server node.
+	sshBastionTag = "ssh-bastion:"
+
+	// ssh-agent authenticates through the running ssh-agent.
+	sshAgentTag = "ssh-agent"
+
+	// ssh-passphrase-env:VAR reads the key file passphrase from $VAR, so the
+	// passphrase itself never ends up in the project.
+	sshPassphraseEnvTag = "ssh-passphrase-env:"
+
+	bastionMaster = "master"
+	sshPort       = "22"
+)
+
+// SSHConfig configures how nodes are reached over SSH.
+type SSHConfig struct {
+	// Bastion is the host:port nodes are reached through, ProxyJump style.
+	Bastion     string
+	BastionUser string
+
+	// BastionHostKey is the host key of the bastion in authorized_keys
+	// format. Without it the bastion has to be in ~/.ssh/known_hosts.
+	BastionHostKey string
+
+	// Agent authenticates with the keys held by ssh-agent before trying
+	// key files.
+	Agent bool
+
+	// Passphrase decrypts encrypted key files.
+	Passphrase string
+
+	// Key is the fingerprint, SHA256 or legacy MD5, of the project key. The
+	// matching key file is tried first, other keys only when it is refused.
+	Key string
+
+	// masters is the project whose first server is the bastion, in
+	// "master" mode. The server and its host key are looked up on every
+	// dial, so a key recorded since is used.
+	masters *ertia.Project
+}
+
+// SSHConfigFor reads the SSH config from the project tags. With
+// ssh-bastion:master the bastion is the first server of cfg, the host key it
+// presents first is recorded on it.
+func SSHConfigFor(cfg *ertia.Project) SSHConfig {
+	var c SSHConfig
+
+	if cfg.SSHKey != nil {
+		c.Key = cfg.SSHKey.Fingerprint
+	}
+
+	for _, tag := range cfg.Tags {
+		switch {
+		case tag == sshAgentTag:
+			c.Agent = true
+		case strings.HasPrefix(tag, sshPassphraseEnvTag):
+			c.Passphrase = os.Getenv(strings.TrimPrefix(tag, sshPassphraseEnvTag))
+		case strings.HasPrefix(tag, sshBastionTag):
+			c.Bastion, c.BastionUser = parseBastion(strings.TrimPrefix(tag, sshBastionTag))
+		}
+	}
+
+	if c.Bastion == bastionMaster {
+		c.Bastion = ""
+		c.masters = cfg
+	}
+
+	return c
+}
+
+// Connect connects to the node over SSH with c, it is a Connector.
+func (c SSHConfig) Connect(ctx context.Context, node ertia.Node) (Executor, error) {
+	exec, _, err := dialNode(ctx, c, node, false)
+	if err != nil {
+		return nil, err
+	}
+	return exec, nil
+}
+
+// bastion returns the host:port and user of the bastion and the node it is,
+// which is only set in "master" mode.
+func (c SSHConfig) bastion() (string, string, *ertia.Node) {
+	if c.masters == nil {
+		return c.Bastion, c.BastionUser, nil
+	}
+
+	for i := range c.masters.Nodes {
+		n := &c.masters.Nodes[i]
+		if n.IsMaster && n.IPV4 != nil && n.Status != ertia.NodeStatusDeleted {
+			user := c.BastionUser
+			if user == "" {
+				user = n.InstallUser
+			}
+			return net.JoinHostPort(n.IPV4.String(), sshPort), user, n
+		}
+	}
+	return "", "", nil
+}
+
+// parseBastion splits [user@]host[:port] into host:port and user.
+func parseBastion(s string) (string, string) {
+	user := ""
+	if i := strings.LastIndex(s, "@"); i >= 0 {
+		user, s = s[:i], s[i+1:]
+	}
+	if s == bastionMaster {
+		return s, user
+	}
+	if _, _, err := net.SplitHostPort(s); err != nil {
+		s = net.JoinHostPort(s, sshPort)
+	}
+	return s, user
+}
+
+// sshIdentity is one way of authenticating, tried in turn.
+type sshIdentity struct {
+	name string
+	auth goph.Auth
+}
+
+// identities lists the project key first, then ssh-agent when enabled, then
+// the other private key files in the keys directory.
+func (c SSHConfig) identities(ctx context.Context) ([]sshIdentity, error) {
+	var project, agent, others []sshIdentity
+
+	if c.Agent {
+		auth, err := goph.UseAgent()
+		if err != nil {
+			log.Ctx(ctx).Warn().Err(err).Msg("ssh-agent not available")
+		} else {
+			agent = append(agent, sshIdentity{name: "ssh-agent", auth: auth})
+		}
+	}
+
+	keyFiles, err := ioutil.ReadDir(config.ErtiaKeysPath())
+	if err != nil && len(agent) == 0 {
+		return nil, err
+	}
+
+	for _, keyFile := range keyFiles {
+		if keyFile.IsDir() || strings.Contains(keyFile.Name(), ".pub") {
+			continue
+		}
+
+		path := filepath.Join(config.ErtiaKeysPath(), keyFile.Name())
+		signer, err := goph.GetSigner(path, c.Passphrase)
+		if err != nil {
+			log.Ctx(ctx).Err(err).Str("key", path).Msg("Could not load private key")
+			continue
+		}
+
+		id := sshIdentity{name: path, auth: goph.Auth{ssh.PublicKeys(signer)}}
+		if c.matchesKey(signer.PublicKey()) {
+			project = append(project, id)
+		} else {
+			others = append(others, id)
+		}
+	}
+
+	if c.Key != "" && len(project) == 0 {
+		log.Ctx(ctx).Warn().Str("fingerprint", c.Key).Msg("Project SSH key not found in keys directory")
+	}
+
+	return append(append(project, agent...), others...), nil
+}
+
+func (c SSHConfig) matchesKey(key ssh.PublicKey) bool {
+	return c.Key != "" && (c.Key == ssh.FingerprintSHA256(key) || c.Key == ssh.FingerprintLegacyMD5(key))
+}
+
+// isAuthError tells whether the server refused the offered keys, as opposed
+// to not being reachable at all.
+func isAuthError(err error) bool {
+	return strings.Contains(err.Error(), "unable to authenticate")
+}
+
+// dialNode connects to the node with the first identity that works, through
+// the bastion when one is configured. The host key has to match the one
+// recorded on the node, an unrecorded key is only accepted with trustNew and
+// returned so it can be recorded.
+func dialNode(ctx context.Context, sc SSHConfig, node ertia.Node, trustNew bool) (*sshExecutor, ssh.PublicKey, error) {
+	release := redact.Node(&node)
+
+	exec, key, err := dialIdentities(ctx, sc, node, trustNew)
+	if err != nil {
+		release()
+		return nil, nil, err
+	}
+	exec.release = release
+	return exec, key, nil
+}
+
+// dialIdentities tries the identities in turn, see dialNode.
+func dialIdentities(ctx context.Context, sc SSHConfig, node ertia.Node, trustNew bool) (*sshExecutor, ssh.PublicKey, error) {
+	ids, err := sc.identities(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	check := &hostKeyCheck{
+		node:     node.Name,
+		expected: NodeHostKey(&node),
+		trustNew: trustNew,
+	}
+
+	host := sc.host(node)
+	addr := net.JoinHostPort(host.String(), sshPort)
+
+	var refused []string
+	for _, id := range ids {
+		clientConfig := &ssh.ClientConfig{
+			User:            node.InstallUser,
+			Auth:            id.auth,
+			Timeout:         goph.DefaultTimeout,
+			HostKeyCallback: check.callback,
+		}
+
+		client, bastion, err := sc.dial(ctx, addr, clientConfig)
+		if check.err != nil {
+			return nil, nil, check.err
+		}
+		if err != nil {
+			if !isAuthError(err) {
+				log.Ctx(ctx).Debug().Err(err).Str("node", node.Name).Msg("SSH not reachable")
+				return nil, nil, fmt.Errorf("%w: %s: %v", ErrorSSHNotReady, node.Name, err)
+			}
+			log.Ctx(ctx).Debug().Str("node", node.Name).Str("key", id.name).Msg("SSH key refused")
+			refused = append(refused, id.name)
+			continue
+		}
+
+		log.Ctx(ctx).Debug().Str("node", node.Name).Str("key", id.name).Msg("SSH connected")
+
+		exec := &sshExecutor{
+			client: &goph.Client{
+				Client: client,
+				Config: &goph.Config{
+					User:     node.InstallUser,
+					Addr:     host.String(),
+					Port:     22,
+					Auth:     id.auth,
+					Timeout:  goph.DefaultTimeout,
+					Callback: check.callback,
+				},
+			},
+			bastion: bastion,
+			key:     id.name,
+		}
+		exec.client.SetPass(node.InstallPassword)
+
+		return exec, check.presented, nil
+	}
+
+	if len(refused) == 0 {
+		return nil, nil, fmt.Errorf("%w: %s: no SSH keys to try", ErrorSSHNotReady, node.Name)
+	}
+	return nil, nil, fmt.Errorf("%w: %s refused %s", ErrorSSHNotReady, node.Name, strings.Join(refused, ", "))
+}
+
+// host is where the node is dialled: its private address when it has one
+// and is reached through a bastion, else its public IPv4.
+func (c SSHConfig) host(node ertia.Node) net.IP {
+	bastion, _, _ := c.bastion()
+	if bastion == "" || node.IPV4 != nil && bastion == net.JoinHostPort(node.IPV4.String(), sshPort) {
+		return node.IPV4
+	}
+	if private := NodePrivateIP(&node); private != nil {
+		return private
+	}
+	return node.IPV4
+}
+
+// dial connects to addr, through the bastion when one is configured and addr
+// is not the bastion itself. The bastion client is returned so it can be
+// closed along with the node client.
+func (c SSHConfig) dial(ctx context.Context, addr string, clientConfig *ssh.ClientConfig) (*ssh.Client, *ssh.Client, error) {
+	bastionAddr, user, bastionNode := c.bastion()
+	if bastionAddr == "" || bastionAddr == addr {
+		client, err := dialContext(ctx, addr, clientConfig)
+		return client, nil, err
+	}
+
+	check := &hostKeyCheck{node: bastionAddr, expected: c.BastionHostKey}
+	callback := check.callback
+	switch {
+	case bastionNode != nil:
+		// Trusted on first use, like the nodes themselves.
+		check.node = bastionNode.Name
+		check.expected = NodeHostKey(bastionNode)
+		check.trustNew = check.expected == ""
+	case c.BastionHostKey == "":
+		knownHosts, err := goph.DefaultKnownHosts()
+		if err != nil {
+			return nil, nil, err
+		}
+		callback = knownHosts
+	}
+
+	if user == "" {
+		user = clientConfig.User
+	}
+
+	bastion, err := dialContext(ctx, bastionAddr, &ssh.ClientConfig{
+		User:            user,
+		Auth:            clientConfig.Auth,
+		Timeout:         clientConfig.Timeout,
+		HostKeyCallback: callback,
+	})
+	if check.err != nil {
+		return nil, nil, check.err
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("bastion %s: %w", bastionAddr, err)
+	}
+
+	if bastionNode != nil && check.trustNew {
+		SetNodeHostKey(bastionNode, string(ssh.MarshalAuthorizedKey(check.presented)))
+		log.Ctx(ctx).Info().
+			Str("node", bastionNode.Name).
+			Str("fingerprint", ssh.FingerprintSHA256(check.presented)).
+			Msg("Trusting SSH host key of bastion")
+	}
+
+	conn, err := bastion.Dial("tcp", addr)
+	if err != nil {
+		bastion.Close()
+		return nil, nil, fmt.Errorf("through bastion %s: %w", bastionAddr, err)
+	}
+
+	clientConn, chans, reqs, err := ssh.NewClientConn(conn, addr, clientConfig)
+	if err != nil {
+		conn.Close()
+		bastion.Close()
+		return nil, nil, err
+	}
+
+	return ssh.NewClient(clientConn, chans, reqs), bastion, nil
+}
+
+// dialContext is ssh.Dial bounded by ctx as well as the client timeout.
+func dialContext(ctx context.Context, addr string, clientConfig *ssh.ClientConfig) (*ssh.Client, error) {
+	dialer := net.Dialer{Timeout: clientConfig.Timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	clientConn, chans, reqs, err := ssh.NewClientConn(conn, addr, clientConfig)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// The deadline only bounds the handshake.
+	conn.SetDeadline(time.Time{})
+
+	return ssh.NewClient(clientConn, chans, reqs), nil
+}
@@ -0,0 +1,245 @@
+package k3s
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+
+	ertia "github.com/ertia-io/config/pkg/entities"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func TestParseBastion(t *testing.T) {
+	cases := []struct {
+		tag  string
+		addr string
+		user string
+	}{
+		{tag: "bastion.example.com", addr: "bastion.example.com:22"},
+		{tag: "jump@bastion.example.com:2222", addr: "bastion.example.com:2222", user: "jump"},
+		{tag: "10.0.0.1", addr: "10.0.0.1:22"},
+		{tag: "[2001:db8::1]:2222", addr: "[2001:db8::1]:2222"},
+		{tag: "jump@master", addr: "master", user: "jump"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.tag, func(t *testing.T) {
+			addr, user := parseBastion(tc.tag)
+			if addr != tc.addr || user != tc.user {
+				t.Errorf("got %s as %q, want %s as %q", addr, user, tc.addr, tc.user)
+			}
+		})
+	}
+}
+
+func TestSSHConfigFor(t *testing.T) {
+	t.Setenv("TEST_SSH_PASSPHRASE", "secret")
+
+	cfg := &ertia.Project{
+		SSHKey: &ertia.SSHKey{Fingerprint: "SHA256:project"},
+		Tags:   []string{"ssh-agent", "ssh-passphrase-env:TEST_SSH_PASSPHRASE", "ssh-bastion:jump@bastion.example.com"},
+	}
+
+	c := SSHConfigFor(cfg)
+	if !c.Agent || c.Passphrase != "secret" || c.Key != "SHA256:project" {
+		t.Errorf("got agent %v, passphrase %q, key %q", c.Agent, c.Passphrase, c.Key)
+	}
+	if addr, user, node := c.bastion(); addr != "bastion.example.com:22" || user != "jump" || node != nil {
+		t.Errorf("got bastion %s as %q on %v", addr, user, node)
+	}
+
+	if c := SSHConfigFor(&ertia.Project{}); c.Agent || c.Bastion != "" || c.masters != nil {
+		t.Errorf("got %+v from a project without tags", c)
+	}
+}
+
+func TestBastionMaster(t *testing.T) {
+	cfg := &ertia.Project{
+		Tags: []string{"ssh-bastion:master"},
+		Nodes: []ertia.Node{
+			{ID: "agent", IPV4: net.ParseIP("192.0.2.1")},
+			{ID: "deleted", IsMaster: true, IPV4: net.ParseIP("192.0.2.2"), Status: ertia.NodeStatusDeleted},
+			{ID: "server", IsMaster: true, IPV4: net.ParseIP("192.0.2.3"), InstallUser: "ertia"},
+		},
+	}
+
+	c := SSHConfigFor(cfg)
+	addr, user, node := c.bastion()
+	if addr != "192.0.2.3:22" || user != "ertia" || node == nil || node.ID != "server" {
+		t.Fatalf("got bastion %s as %q on %v, want the server", addr, user, node)
+	}
+
+	// Servers added since are picked up on the next dial.
+	cfg.Nodes[2].Status = ertia.NodeStatusDeleted
+	cfg.Nodes = append(cfg.Nodes, ertia.Node{ID: "replacement", IsMaster: true, IPV4: net.ParseIP("192.0.2.4")})
+	if addr, _, _ := c.bastion(); addr != "192.0.2.4:22" {
+		t.Errorf("got bastion %s, want the replacement server", addr)
+	}
+}
+
+func TestSSHHost(t *testing.T) {
+	private := ertia.Node{Name: "private", IPV4: net.ParseIP("192.0.2.1")}
+	SetNodePrivateIP(&private, net.ParseIP("10.0.0.1"))
+
+	cases := []struct {
+		name    string
+		bastion string
+		node    ertia.Node
+		want    string
+	}{
+		{name: "direct", node: private, want: "192.0.2.1"},
+		{name: "through bastion", bastion: "bastion.example.com:22", node: private, want: "10.0.0.1"},
+		{name: "bastion itself", bastion: "192.0.2.1:22", node: private, want: "192.0.2.1"},
+		{name: "no private address", bastion: "bastion.example.com:22", node: ertia.Node{IPV4: net.ParseIP("192.0.2.2")}, want: "192.0.2.2"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := (SSHConfig{Bastion: tc.bastion}).host(tc.node); got.String() != tc.want {
+				t.Errorf("got host %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+// writeKey writes a new private key to dir and returns its public key.
+func writeKey(t *testing.T, dir, name string) ssh.PublicKey {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pub, err := ssh.NewPublicKey(&priv.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(dir, name), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, name+".pub"), ssh.MarshalAuthorizedKey(pub), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pub
+}
+
+// startAgent serves an empty ssh-agent and points SSH_AUTH_SOCK at it.
+func startAgent(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "agent.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	keyring := agent.NewKeyring()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go agent.ServeAgent(keyring, conn)
+		}
+	}()
+
+	t.Setenv("SSH_AUTH_SOCK", sock)
+}
+
+func TestIdentities(t *testing.T) {
+	keys := t.TempDir()
+	writeKey(t, keys, "a")
+	project := writeKey(t, keys, "b")
+	writeKey(t, keys, "c")
+
+	cases := []struct {
+		name  string
+		keys  string
+		agent bool
+		c     SSHConfig
+
+		want []string
+		err  bool
+	}{
+		{
+			name: "project key first",
+			keys: keys,
+			c:    SSHConfig{Key: ssh.FingerprintSHA256(project)},
+			want: []string{"b", "a", "c"},
+		},
+		{
+			name: "legacy fingerprint",
+			keys: keys,
+			c:    SSHConfig{Key: ssh.FingerprintLegacyMD5(project)},
+			want: []string{"b", "a", "c"},
+		},
+		{
+			name:  "agent after project key",
+			keys:  keys,
+			agent: true,
+			c:     SSHConfig{Key: ssh.FingerprintSHA256(project), Agent: true},
+			want:  []string{"b", "ssh-agent", "a", "c"},
+		},
+		{
+			name: "agent not running",
+			keys: keys,
+			c:    SSHConfig{Agent: true},
+			want: []string{"a", "b", "c"},
+		},
+		{
+			name:  "agent without keys directory",
+			keys:  filepath.Join(keys, "missing"),
+			agent: true,
+			c:     SSHConfig{Agent: true},
+			want:  []string{"ssh-agent"},
+		},
+		{
+			name: "no keys directory",
+			keys: filepath.Join(keys, "missing"),
+			err:  true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("ERTIAKEYS", tc.keys)
+			t.Setenv("SSH_AUTH_SOCK", filepath.Join(keys, "no-agent.sock"))
+			if tc.agent {
+				startAgent(t)
+			}
+
+			ids, err := tc.c.identities(context.Background())
+			if (err != nil) != tc.err {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			var got []string
+			for _, id := range ids {
+				got = append(got, filepath.Base(id.name))
+			}
+			if len(got) != len(tc.want) {
+				t.Fatalf("got identities %v, want %v", got, tc.want)
+			}
+			for i := range got {
+				if got[i] != tc.want[i] {
+					t.Fatalf("got identities %v, want %v", got, tc.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package k3s
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	ertia "github.com/ertia-io/config/pkg/entities"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	ErrorTimeout = errors.New("K3S.Timeout")
+)
+
+// Project tags overriding the install timeouts, e.g. timeout-install:15m.
+const (
+	timeoutConnectTag   = "timeout-connect:"
+	timeoutUploadTag    = "timeout-upload:"
+	timeoutInstallTag   = "timeout-install:"
+	timeoutReadinessTag = "timeout-readiness:"
+)
+
+// Timeouts bound the phases of an install.
+type Timeouts struct {
+	// Connect bounds establishing the connection to the node.
+	Connect time.Duration
+
+	// Upload bounds copying the installer and config to the node and
+	// reading the token and kubeconfig back.
+	Upload time.Duration
+
+	// Install bounds running the install script.
+	Install time.Duration
+
+	// Readiness bounds waiting for the node to become Ready.
+	Readiness time.Duration
+}
+
+// DefaultTimeouts are used for phases without a timeout of their own.
+var DefaultTimeouts = Timeouts{
+	Connect:   30 * time.Second,
+	Upload:    2 * time.Minute,
+	Install:   10 * time.Minute,
+	Readiness: 5 * time.Minute,
+}
+
+// TimeoutError reports the install phase whose timeout expired.
+type TimeoutError struct {
+	Node    string
+	Phase   Phase
+	Timeout time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%s: %s timed out after %s on %s", ErrorTimeout, e.Phase, e.Timeout, e.Node)
+}
+
+// Is matches ErrorTimeout, and ErrorSSHNotReady while connecting since a node
+// that does not answer in time may just not be up yet.
+func (e *TimeoutError) Is(target error) bool {
+	return target == ErrorTimeout || target == ErrorSSHNotReady && e.Phase == PhaseConnecting
+}
+
+// TimeoutsFor reads the timeouts from the project tags, falling back to
+// DefaultTimeouts.
+func TimeoutsFor(ctx context.Context, cfg *ertia.Project) Timeouts {
+	t := DefaultTimeouts
+
+	for _, tag := range cfg.Tags {
+		var target *time.Duration
+		var value string
+		switch {
+		case strings.HasPrefix(tag, timeoutConnectTag):
+			target, value = &t.Connect, strings.TrimPrefix(tag, timeoutConnectTag)
+		case strings.HasPrefix(tag, timeoutUploadTag):
+			target, value = &t.Upload, strings.TrimPrefix(tag, timeoutUploadTag)
+		case strings.HasPrefix(tag, timeoutInstallTag):
+			target, value = &t.Install, strings.TrimPrefix(tag, timeoutInstallTag)
+		case strings.HasPrefix(tag, timeoutReadinessTag):
+			target, value = &t.Readiness, strings.TrimPrefix(tag, timeoutReadinessTag)
+		default:
+			continue
+		}
+
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			log.Ctx(ctx).Warn().Str("tag", tag).Msg("Ignoring invalid timeout")
+			continue
+		}
+		*target = d
+	}
+
+	return t
+}
+
+// orDefault fills unset timeouts from DefaultTimeouts.
+func (t Timeouts) orDefault() Timeouts {
+	if t.Connect <= 0 {
+		t.Connect = DefaultTimeouts.Connect
+	}
+	if t.Upload <= 0 {
+		t.Upload = DefaultTimeouts.Upload
+	}
+	if t.Install <= 0 {
+		t.Install = DefaultTimeouts.Install
+	}
+	if t.Readiness <= 0 {
+		t.Readiness = DefaultTimeouts.Readiness
+	}
+	return t
+}
+
+// withTimeout runs fn bounded by timeout. When the timeout, and not ctx,
+// expires the error names the phase.
+func withTimeout(ctx context.Context, node string, phase Phase, timeout time.Duration, fn func(ctx context.Context) error) error {
+	phaseCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	err := fn(phaseCtx)
+	if err != nil && ctx.Err() == nil && errors.Is(phaseCtx.Err(), context.DeadlineExceeded) {
+		return &TimeoutError{Node: node, Phase: phase, Timeout: timeout}
+	}
+	return err
+}
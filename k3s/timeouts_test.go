@@ -0,0 +1,41 @@
+package k3s_test
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	ertia "github.com/ertia-io/config/pkg/entities"
+	"github.com/ertia-io/providers/k3s"
+	"github.com/rs/zerolog"
+)
+
+func TestTimeoutsFor(t *testing.T) {
+	var logs bytes.Buffer
+	logger := zerolog.New(&logs)
+	ctx := logger.WithContext(context.Background())
+
+	cfg := &ertia.Project{Tags: []string{
+		"timeout-connect:30s",
+		"timeout-install:20m",
+		"timeout-upload:soon",
+		"timeout-readiness:-1m",
+	}}
+
+	got := k3s.TimeoutsFor(ctx, cfg)
+
+	want := k3s.DefaultTimeouts
+	want.Connect = 30 * time.Second
+	want.Install = 20 * time.Minute
+	if got != want {
+		t.Errorf("got timeouts %+v, want %+v", got, want)
+	}
+
+	for _, tag := range []string{"timeout-upload:soon", "timeout-readiness:-1m"} {
+		if !strings.Contains(logs.String(), tag) {
+			t.Errorf("invalid tag %s not logged through the context logger: %s", tag, logs.String())
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package providers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	ertia "github.com/ertia-io/config/pkg/entities"
+	"github.com/ertia-io/providers/dependencies"
+	"github.com/ertia-io/providers/k3s"
+	"github.com/ertia-io/providers/redact"
+)
+
+// Definition IDs of the k3s dependency graph.
+const (
+	K3SServer = "k3s-server"
+	K3SAgent  = "k3s-agent"
+)
+
+// K3SDefinitions install k3s with the options of p: servers first, agents
+// once a server is ready.
+func K3SDefinitions(p NodeProvider) []dependencies.Definition {
+	return []dependencies.Definition{
+		{
+			ID:         K3SServer,
+			Dependency: dependencies.K3SDependency.Name,
+			Applies:    isMaster,
+			Serial:     true,
+			Install: func(ctx context.Context, cfg *ertia.Project, node *ertia.Node) (*ertia.Project, error) {
+				return installK3SServer(ctx, cfg, node, k3sInstallOptions(ctx, p, cfg, node))
+			},
+			Ready: k3sReady(p),
+		},
+		{
+			ID:         K3SAgent,
+			Dependency: dependencies.K3SDependency.Name,
+			Applies:    func(node *ertia.Node) bool { return !node.IsMaster },
+			Requires:   []dependencies.Requirement{{ID: K3SServer, Scope: dependencies.AnyNode}},
+			Install: func(ctx context.Context, cfg *ertia.Project, node *ertia.Node) (*ertia.Project, error) {
+				return installK3SAgent(ctx, cfg, node, k3sInstallOptions(ctx, p, cfg, node))
+			},
+			Ready: k3sReady(p),
+		},
+	}
+}
+
+// SyncDependencies installs what the nodes of the project require with the
+// k3s definitions and Helm charts of p and any extra definitions, retrying
+// and installing in parallel as the project tags allow.
+func SyncDependencies(ctx context.Context, p NodeProvider, cfg *ertia.Project, extra ...dependencies.Definition) (*ertia.Project, error) {
+	defer redact.Project(cfg)()
+
+	cfg, charts := helmCharts(p, cfg)
+	defs := append(K3SDefinitions(p), charts...)
+
+	graph, err := dependencies.NewGraph(append(defs, extra...)...)
+	if err != nil {
+		return cfg, err
+	}
+	graph.Retry = dependencies.RetryPolicyFor(ctx, cfg)
+	graph.Concurrency = dependencies.ConcurrencyFor(ctx, cfg)
+
+	return graph.Sync(ctx, cfg)
+}
+
+func isMaster(node *ertia.Node) bool {
+	return node.IsMaster
+}
+
+// clusterInit tells whether the first server should run embedded etcd, which
+// is needed as soon as there is more than one server or a shared endpoint.
+func clusterInit(cfg *ertia.Project, endpoint string) bool {
+	if endpoint != "" {
+		return true
+	}
+
+	masters := 0
+	for i := range cfg.Nodes {
+		if cfg.Nodes[i].IsMaster {
+			masters++
+		}
+	}
+	return masters > 1
+}
+
+// installK3SServer initialises the cluster on the first server and joins
+// every later server to it through the endpoint. Later servers wait while the
+// first one is not ready, even when it failed, rather than initialising a
+// cluster of their own.
+func installK3SServer(ctx context.Context, cfg *ertia.Project, node *ertia.Node, opts k3s.InstallOptions) (*ertia.Project, error) {
+	err := opts.TrustHostKey(ctx, node)
+	if err != nil {
+		return cfg, notReady(err)
+	}
+
+	server := controlNode(cfg, *node)
+
+	if server == nil {
+		if init := k3s.InitServer(cfg); init != nil && init.ID != node.ID {
+			return cfg, fmt.Errorf("%w: %s waits for the cluster to be initialised on %s", dependencies.ErrorNotReady, node.Name, init.Name)
+		}
+
+		// Recorded even when the install fails, so it is retried here.
+		k3s.SetInitServer(node)
+		cfg = cfg.UpdateNode(node)
+
+		opts.ClusterInit = clusterInit(cfg, opts.Endpoint)
+		nodeToken, err := k3s.InstallK3SServer(ctx, *node, opts)
+		if err != nil {
+			return cfg, notReady(err)
+		}
+		node.NodeToken = nodeToken
+	} else {
+		node.MasterIP = server.IPV4
+		node.NodeToken = server.NodeToken
+
+		err := k3s.JoinK3SServer(ctx, *node, joinHost(opts, *server), opts)
+		if err != nil {
+			return cfg, notReady(err)
+		}
+	}
+
+	k3s.RecordVersion(ctx, opts.Connector(), node)
+
+	return cfg.UpdateNode(node), nil
+}
+
+// installK3SAgent joins an agent through the endpoint.
+func installK3SAgent(ctx context.Context, cfg *ertia.Project, node *ertia.Node, opts k3s.InstallOptions) (*ertia.Project, error) {
+	server := controlNode(cfg, *node)
+	if server == nil {
+		return cfg, fmt.Errorf("no ready server for %s to join", node.Name)
+	}
+
+	err := opts.TrustHostKey(ctx, node)
+	if err != nil {
+		return cfg, notReady(err)
+	}
+
+	node.MasterIP = server.IPV4
+	node.NodeToken = server.NodeToken
+
+	err = k3s.InstallK3SAgent(ctx, *node, joinHost(opts, *server), opts)
+	if err != nil {
+		return cfg, notReady(err)
+	}
+
+	k3s.RecordVersion(ctx, opts.Connector(), node)
+
+	return cfg.UpdateNode(node), nil
+}
+
+// k3sReady checks that the node is Ready and the system pods run. With an
+// external cloud provider the pods wait for its controller, so only the node
+// is checked.
+func k3sReady(p NodeProvider) dependencies.ReadinessCheck {
+	return func(ctx context.Context, cfg *ertia.Project, node *ertia.Node) error {
+		control := *node
+		if server := controlNode(cfg, *node); server != nil {
+			control = *server
+		}
+
+		opts := k3sInstallOptions(ctx, p, cfg, node)
+		if opts.ExternalCloudProvider {
+			return k3s.WaitForNodeReady(ctx, opts.Connector(), control, node.Name, opts.Timeouts.Readiness)
+		}
+		return k3s.WaitForReady(ctx, opts.Connector(), control, node.Name, opts.Timeouts.Readiness)
+	}
+}
+
+// joinHost is where new nodes reach the cluster: the endpoint, or the server.
+func joinHost(opts k3s.InstallOptions, server ertia.Node) string {
+	if opts.Endpoint != "" {
+		return opts.Endpoint
+	}
+	return server.IPV4.String()
+}
+
+// notReady lets the dependency graph retry installs on nodes SSH can not
+// reach yet.
+func notReady(err error) error {
+	if errors.Is(err, k3s.ErrorSSHNotReady) {
+		return fmt.Errorf("%w: %v", dependencies.ErrorNotReady, err)
+	}
+	return err
+}
@@ -0,0 +1,119 @@
+package providers
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	ertia "github.com/ertia-io/config/pkg/entities"
+	"github.com/ertia-io/providers/dependencies"
+	"github.com/ertia-io/providers/k3s"
+	"github.com/ertia-io/providers/k3s/k3stest"
+)
+
+const serverKubeconfig = `apiVersion: v1
+kind: Config
+clusters:
+- name: default
+  cluster:
+    server: https://127.0.0.1:6443
+contexts:
+- name: default
+  context:
+    cluster: default
+    user: default
+users:
+- name: default
+  user:
+    token: secret
+current-context: default
+`
+
+func newFakeServer() *k3stest.FakeExecutor {
+	f := k3stest.NewFakeExecutor()
+	f.Files["/var/lib/rancher/k3s/server/node-token"] = []byte("K10token::server:secret\n")
+	f.Files["/etc/rancher/k3s/k3s.yaml"] = []byte(serverKubeconfig)
+	return f
+}
+
+func twoServers(first ertia.Node) *ertia.Project {
+	first.ID, first.Name, first.IsMaster, first.IPV4 = "a", "server-a", true, net.ParseIP("10.0.0.1")
+	return &ertia.Project{Name: "project", Nodes: []ertia.Node{
+		first,
+		{ID: "b", Name: "server-b", IsMaster: true, IPV4: net.ParseIP("10.0.0.2")},
+	}}
+}
+
+func TestInstallK3SServer(t *testing.T) {
+	initialised := ertia.Node{NodeToken: "K10token::server:secret"}
+	k3s.SetInitServer(&initialised)
+
+	failed := initialised
+	failed.Dependencies = []ertia.Dependency{{Name: dependencies.K3SDependency.Name, Status: ertia.DependencyStatusFailing}}
+
+	ready := initialised
+	ready.Dependencies = []ertia.Dependency{{Name: dependencies.K3SDependency.Name, Status: ertia.DependencyStatusReady}}
+
+	cases := []struct {
+		name    string
+		cfg     *ertia.Project
+		install string
+
+		// command is expected among the commands run, none when empty.
+		command string
+		init    bool
+		err     error
+	}{
+		{
+			name:    "first server initialises the cluster",
+			cfg:     twoServers(ertia.Node{}),
+			install: "a",
+			command: "server --cluster-init",
+			init:    true,
+		},
+		{
+			name:    "waits for the init server that failed",
+			cfg:     twoServers(failed),
+			install: "b",
+			err:     dependencies.ErrorNotReady,
+		},
+		{
+			name:    "retries the init server",
+			cfg:     twoServers(failed),
+			install: "a",
+			command: "server --cluster-init",
+			init:    true,
+		},
+		{
+			name:    "joins the ready server",
+			cfg:     twoServers(ready),
+			install: "b",
+			command: "K3S_URL=https://10.0.0.1:6443",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("ERTIAKUBE", t.TempDir())
+
+			f := newFakeServer()
+			node := tc.cfg.FindNodeByID(tc.install)
+
+			cfg, err := installK3SServer(context.Background(), tc.cfg, node, k3s.InstallOptions{Connect: f.Connect})
+
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("got error %v, want %v", err, tc.err)
+			}
+
+			ran := strings.Join(f.Commands, "\n")
+			if tc.command == "" && len(f.Commands) > 0 || !strings.Contains(ran, tc.command) {
+				t.Errorf("ran %q, want %q", ran, tc.command)
+			}
+			if got := k3s.IsInitServer(cfg.FindNodeByID(tc.install)); got != tc.init {
+				t.Errorf("init server %v, want %v", got, tc.init)
+			}
+		})
+	}
+}
@@ -0,0 +1,28 @@
+package providers
+
+import (
+	"context"
+
+	ertia "github.com/ertia-io/config/pkg/entities"
+	"github.com/ertia-io/providers/k3s"
+	"github.com/rs/zerolog/log"
+)
+
+// RemoveKubeconfig removes the kubeconfig of the project once node, its last
+// server, is deleted. Failures are only logged, the servers are gone.
+func RemoveKubeconfig(ctx context.Context, cfg *ertia.Project, node *ertia.Node, o k3s.KubeconfigOptions) {
+	if !node.IsMaster {
+		return
+	}
+	for i := range cfg.Nodes {
+		n := &cfg.Nodes[i]
+		if n.IsMaster && n.ID != node.ID && n.Status != ertia.NodeStatusDeleted {
+			return
+		}
+	}
+
+	err := k3s.RemoveKubeconfig(o)
+	if err != nil {
+		log.Ctx(ctx).Warn().Err(err).Str("project", cfg.Name).Msg("Could not remove kubeconfig")
+	}
+}
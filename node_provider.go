@@ -4,6 +4,7 @@ import (
 	"context"
 
 	ertia "github.com/ertia-io/config/pkg/entities"
+	"github.com/ertia-io/providers/k3s"
 )
 
 type NodeProvider interface {
@@ -17,3 +18,23 @@ type NodeProvider interface {
 	SyncNodes(ctx context.Context, cfg *ertia.Project) (*ertia.Project, error)
 	SyncDependencies(ctx context.Context, cfg *ertia.Project) (*ertia.Project, error)
 }
+
+// K3SConfigurer is implemented by node providers that customise how k3s is
+// installed on their nodes.
+type K3SConfigurer interface {
+	K3SInstallOptions(ctx context.Context, cfg *ertia.Project, node *ertia.Node) k3s.InstallOptions
+}
+
+// k3sInstallOptions asks the provider for install options, falling back to
+// the project channel and timeouts.
+func k3sInstallOptions(ctx context.Context, p NodeProvider, cfg *ertia.Project, node *ertia.Node) k3s.InstallOptions {
+	if c, ok := p.(K3SConfigurer); ok {
+		return c.K3SInstallOptions(ctx, cfg, node)
+	}
+	return k3s.InstallOptions{
+		Channel:  cfg.K3SChannel,
+		Endpoint: k3s.EndpointFor(cfg, ""),
+		SSH:      k3s.SSHConfigFor(cfg),
+		Timeouts: k3s.TimeoutsFor(ctx, cfg),
+	}
+}
@@ -0,0 +1,162 @@
+// Package redact keeps secrets out of logs. Secrets are registered as they
+// become known and masked, together with anything that looks like a token or
+// password, before log output is written. Logs go through the redaction
+// once Install is called, or when the logger passed in through the context
+// wraps its output with Writer.
+package redact
+
+import (
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+
+	ertia "github.com/ertia-io/config/pkg/entities"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// Mask replaces redacted values.
+const Mask = "[REDACTED]"
+
+// Shorter values are not registered, masking them would garble the logs.
+const minSecretLength = 6
+
+// secrets counts the registrations of each value, it is masked until the
+// last one is released. kept holds the values registered by Keep.
+var (
+	mu      sync.RWMutex
+	secrets = map[string]int{}
+	kept    = map[string]bool{}
+)
+
+// patterns catch secrets that were never registered. The first group is
+// kept, the rest of the match is masked.
+var patterns = []*regexp.Regexp{
+	// k3s join tokens, K10<ca hash>::<user>:<password>.
+	regexp.MustCompile(`()K10[0-9a-f]+::[a-z]+:[0-9a-zA-Z]+`),
+	regexp.MustCompile(`(K3S_TOKEN=)\S+`),
+	regexp.MustCompile(`(?i)((?:token|password|passwd|secret|passphrase)[a-z_-]*\\?"?\s*[:=]\s*\\?"?)[^\s"\\,}]+`),
+	regexp.MustCompile(`(?i)(Authorization:\s*(?:Bearer|Basic)\s+)\S+`),
+}
+
+// Install makes the global zerolog logger and zerolog.DefaultContextLogger,
+// which log.Ctx falls back to for contexts without a logger, write to w
+// through Writer. It is meant to be called once at startup by programs that
+// do not pass their own logger in through the context.
+func Install(w io.Writer) {
+	log.Logger = log.Output(Writer(w))
+
+	if zerolog.DefaultContextLogger == nil {
+		zerolog.DefaultContextLogger = &log.Logger
+		return
+	}
+	l := zerolog.DefaultContextLogger.Output(Writer(w))
+	zerolog.DefaultContextLogger = &l
+}
+
+// Secret registers values to be masked wherever they show up. The returned
+// func releases them again.
+func Secret(values ...string) func() {
+	mu.Lock()
+	defer mu.Unlock()
+
+	var registered []string
+	for _, v := range values {
+		v = strings.TrimSpace(v)
+		if len(v) >= minSecretLength {
+			secrets[v]++
+			registered = append(registered, v)
+		}
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { forget(registered) })
+	}
+}
+
+// Keep registers values to be masked for the life of the process, e.g. the
+// tokens of long lived API clients. Keeping a value again has no effect.
+func Keep(values ...string) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	for _, v := range values {
+		v = strings.TrimSpace(v)
+		if len(v) >= minSecretLength && !kept[v] {
+			kept[v] = true
+			secrets[v]++
+		}
+	}
+}
+
+func forget(values []string) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	for _, v := range values {
+		secrets[v]--
+		if secrets[v] <= 0 {
+			delete(secrets, v)
+		}
+	}
+}
+
+// Project registers the secrets of a project for the duration of an
+// operation: the provider token, the private key and the tokens and install
+// passwords of its nodes. Release them when done,
+//
+//	defer redact.Project(cfg)()
+func Project(cfg *ertia.Project) func() {
+	if cfg == nil {
+		return func() {}
+	}
+
+	values := []string{cfg.ProviderToken}
+	if cfg.SSHKey != nil {
+		values = append(values, cfg.SSHKey.PrivateKey)
+	}
+	for _, node := range cfg.Nodes {
+		values = append(values, node.NodeToken, node.InstallPassword)
+	}
+	return Secret(values...)
+}
+
+// Node registers the token and install password of a node, like Project.
+func Node(node *ertia.Node) func() {
+	return Secret(node.NodeToken, node.InstallPassword)
+}
+
+// String masks registered secrets and anything looking like one in s.
+func String(s string) string {
+	mu.RLock()
+	for secret := range secrets {
+		s = strings.ReplaceAll(s, secret, Mask)
+	}
+	mu.RUnlock()
+
+	for _, p := range patterns {
+		s = p.ReplaceAllString(s, "${1}"+Mask)
+	}
+	return s
+}
+
+// Writer masks secrets in everything written to w. Loggers passed in through
+// the context should wrap their output with it, e.g.
+// zerolog.New(redact.Writer(os.Stderr)), see Install for the others.
+func Writer(w io.Writer) io.Writer {
+	return &writer{w: w}
+}
+
+type writer struct {
+	w io.Writer
+}
+
+func (r *writer) Write(p []byte) (int, error) {
+	_, err := io.WriteString(r.w, String(string(p)))
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
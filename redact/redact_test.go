@@ -0,0 +1,87 @@
+package redact_test
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/ertia-io/providers/redact"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+func TestSecretRelease(t *testing.T) {
+	const secret = "s3cret-value"
+
+	first := redact.Secret(secret)
+	second := redact.Secret(secret)
+
+	if got := redact.String("pass " + secret); got != "pass "+redact.Mask {
+		t.Fatalf("registered secret not masked: %q", got)
+	}
+
+	first()
+	first()
+	if got := redact.String("pass " + secret); got != "pass "+redact.Mask {
+		t.Fatalf("secret unmasked while still registered: %q", got)
+	}
+
+	second()
+	if got := redact.String("pass " + secret); got != "pass "+secret {
+		t.Fatalf("released secret still masked: %q", got)
+	}
+}
+
+func TestKeep(t *testing.T) {
+	const token = "api-token-kept"
+
+	redact.Keep(token)
+	redact.Keep(token)
+
+	release := redact.Secret(token)
+	release()
+
+	if got := redact.String("token " + token); got != "token "+redact.Mask {
+		t.Fatalf("kept token unmasked after a release: %q", got)
+	}
+}
+
+func TestInstall(t *testing.T) {
+	savedLogger, savedContextLogger := log.Logger, zerolog.DefaultContextLogger
+	t.Cleanup(func() { log.Logger, zerolog.DefaultContextLogger = savedLogger, savedContextLogger })
+
+	const secret = "installed-secret"
+	defer redact.Secret(secret)()
+
+	var contextLogger bytes.Buffer
+	ctxLogger := zerolog.New(&contextLogger)
+
+	cases := []struct {
+		name    string
+		context *zerolog.Logger
+	}{
+		{name: "without context logger"},
+		{name: "wraps context logger", context: &ctxLogger},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			zerolog.DefaultContextLogger = tc.context
+
+			var out bytes.Buffer
+			redact.Install(&out)
+
+			log.Info().Msg("global " + secret)
+			log.Ctx(context.Background()).Info().Msg("context " + secret)
+
+			if strings.Contains(out.String(), secret) || strings.Count(out.String(), redact.Mask) != 2 {
+				t.Errorf("logged %q, want both lines redacted", out.String())
+			}
+		})
+	}
+
+	if contextLogger.Len() > 0 {
+		t.Errorf("context logger still writes to its own output: %q", contextLogger.String())
+	}
+}
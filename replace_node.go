@@ -0,0 +1,272 @@
+package providers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	ertia "github.com/ertia-io/config/pkg/entities"
+	"github.com/ertia-io/providers/dependencies"
+	"github.com/ertia-io/providers/k3s"
+	"github.com/ertia-io/providers/redact"
+	"github.com/rs/zerolog/log"
+	"github.com/segmentio/ksuid"
+)
+
+var (
+	ErrorNotEnoughServers = errors.New("Providers.NotEnoughServers")
+)
+
+var (
+	// ReplaceReadyTimeout bounds how long a replacement node may take to
+	// be provisioned, join the cluster and become Ready.
+	ReplaceReadyTimeout = 15 * time.Minute
+
+	// ReplaceDrainTimeout bounds how long evicting pods from the old node may take.
+	ReplaceDrainTimeout = 5 * time.Minute
+)
+
+const sshRetryInterval = 5 * time.Second
+
+// ServerDestroyer is implemented by node providers that can delete the server
+// of a node without draining it or removing it from the cluster first.
+type ServerDestroyer interface {
+	DestroyServer(ctx context.Context, cfg *ertia.Project, nodeId string) (*ertia.Project, error)
+}
+
+// MinReplaceServers is the fewest servers a cluster needs for one of them to
+// be replaced. A single server keeps the cluster state to itself, in SQLite
+// without a control plane endpoint, so there is nothing for a replacement to
+// join and take the state over from. With fewer than three etcd members a
+// dead server to replace already costs the cluster its quorum. Agents can
+// always be replaced.
+const MinReplaceServers = 3
+
+// ReplaceNode provisions a fresh server through the provider, joins it to the
+// cluster with the same role as the old node, drains the old node and removes
+// it from the cluster and etcd before its server is deleted. The old node is
+// kept if the replacement never becomes ready. Servers are only replaced in
+// clusters of at least MinReplaceServers servers, ErrorNotEnoughServers is
+// returned for smaller ones.
+func ReplaceNode(ctx context.Context, p NodeProvider, cfg *ertia.Project, nodeId string) (*ertia.Project, error) {
+	defer redact.Project(cfg)()
+
+	old := cfg.FindNodeByID(nodeId)
+	if old == nil {
+		return cfg, fmt.Errorf("node %s not found", nodeId)
+	}
+	oldNode := *old
+
+	if oldNode.IsMaster {
+		if n := countServers(cfg); n < MinReplaceServers {
+			return cfg, fmt.Errorf("%w: replacing server %s needs %d servers to keep the cluster state and etcd quorum, the cluster has %d", ErrorNotEnoughServers, oldNode.Name, MinReplaceServers, n)
+		}
+	}
+
+	control := controlNode(cfg, oldNode)
+	if control == nil {
+		return cfg, fmt.Errorf("no ready server node to replace %s through", oldNode.Name)
+	}
+	opts := k3sInstallOptions(ctx, p, cfg, control)
+	err := opts.TrustHostKey(ctx, control)
+	if err != nil {
+		return cfg, err
+	}
+	// Copied, the node slice is appended to and shuffled below.
+	server := *control
+	connect := opts.Connector()
+
+	replacement := ertia.Node{
+		ID:        ksuid.New().String(),
+		Name:      ertia.NodeName(),
+		IsMaster:  oldNode.IsMaster,
+		MasterIP:  server.IPV4,
+		NodeToken: server.NodeToken,
+		Tags:      k3s.WithoutNodeState(oldNode.Tags),
+		Status:    ertia.NodeStatusNew,
+		Created:   time.Now(),
+		Updated:   time.Now(),
+		Features:  oldNode.Features,
+	}
+	cfg.Nodes = append(cfg.Nodes, replacement)
+
+	log.Ctx(ctx).Info().Str("old", oldNode.Name).Str("new", replacement.Name).Msg("Replacing node")
+
+	cfg, err = p.CreateNode(ctx, cfg, cfg.FindNodeByID(replacement.ID))
+	if err != nil {
+		return rollbackReplacement(ctx, p, cfg, replacement.ID, connect, server, err)
+	}
+
+	readyCtx, cancel := context.WithTimeout(ctx, ReplaceReadyTimeout)
+	defer cancel()
+
+	cfg, err = joinReplacement(readyCtx, p, cfg, replacement.ID, server)
+	if err != nil {
+		return rollbackReplacement(ctx, p, cfg, replacement.ID, connect, server, err)
+	}
+
+	newNode := cfg.FindNodeByID(replacement.ID)
+	err = k3s.WaitForNodeReady(readyCtx, connect, server, newNode.Name, ReplaceReadyTimeout)
+	if err != nil {
+		return rollbackReplacement(ctx, p, cfg, replacement.ID, connect, server, err)
+	}
+
+	// The old server may be the one we talk to the cluster through.
+	if server.ID == oldNode.ID {
+		server = *newNode
+	}
+
+	err = k3s.DrainNode(ctx, connect, server, oldNode.Name, ReplaceDrainTimeout)
+	if err != nil {
+		log.Ctx(ctx).Error().Err(err).Str("node", oldNode.Name).Msg("Could not drain replaced node")
+		return cfg, err
+	}
+
+	// Stopped first so it does not register again, the old server may be
+	// unreachable already.
+	err = k3s.StopK3S(ctx, connect, oldNode)
+	if err != nil {
+		log.Ctx(ctx).Warn().Err(err).Str("node", oldNode.Name).Msg("Could not stop k3s on replaced node")
+	}
+
+	err = k3s.RemoveNode(ctx, connect, server, oldNode.Name)
+	if err != nil {
+		log.Ctx(ctx).Error().Err(err).Str("node", oldNode.Name).Msg("Could not remove replaced node from cluster")
+		return cfg, err
+	}
+
+	cfg, err = destroyServer(ctx, p, cfg, oldNode.ID)
+	if err != nil {
+		return cfg, err
+	}
+
+	return rejoinNodes(cfg.RemoveNode(&oldNode), oldNode), nil
+}
+
+// rejoinNodes points the nodes that joined through a removed server at
+// another ready server, never at themselves.
+func rejoinNodes(cfg *ertia.Project, oldNode ertia.Node) *ertia.Project {
+	for i := range cfg.Nodes {
+		n := &cfg.Nodes[i]
+		if oldNode.IPV4 == nil || !n.MasterIP.Equal(oldNode.IPV4) {
+			continue
+		}
+		n.MasterIP = nil
+		if control := controlNode(cfg, *n); control != nil && control.ID != n.ID {
+			n.MasterIP = control.IPV4
+		}
+	}
+	return cfg
+}
+
+// countServers counts the servers of the cluster that are not deleted.
+func countServers(cfg *ertia.Project) int {
+	n := 0
+	for _, node := range cfg.Nodes {
+		if node.IsMaster && node.Status != ertia.NodeStatusDeleted {
+			n++
+		}
+	}
+	return n
+}
+
+// destroyServer deletes the server of a node that is out of the cluster
+// already or never became ready, so it is not drained again.
+func destroyServer(ctx context.Context, p NodeProvider, cfg *ertia.Project, nodeId string) (*ertia.Project, error) {
+	if d, ok := p.(ServerDestroyer); ok {
+		return d.DestroyServer(ctx, cfg, nodeId)
+	}
+	return p.DeleteNode(ctx, cfg, nodeId)
+}
+
+// controlNode picks a ready server to run cluster commands through, preferring
+// one that is not about to be replaced.
+func controlNode(cfg *ertia.Project, replaced ertia.Node) *ertia.Node {
+	var fallback *ertia.Node
+	for i := range cfg.Nodes {
+		n := &cfg.Nodes[i]
+		if !n.IsMaster || !n.Fulfils(dependencies.K3SDependency.Name) {
+			continue
+		}
+		if n.ID != replaced.ID {
+			return n
+		}
+		fallback = n
+	}
+	return fallback
+}
+
+// joinReplacement installs k3s on the replacement with the role it takes
+// over, retrying until SSH is reachable.
+func joinReplacement(ctx context.Context, p NodeProvider, cfg *ertia.Project, nodeId string, server ertia.Node) (*ertia.Project, error) {
+	node := cfg.FindNodeByID(nodeId)
+	opts := k3sInstallOptions(ctx, p, cfg, node)
+
+	host := joinHost(opts, server)
+
+	install := func() error {
+		err := opts.TrustHostKey(ctx, node)
+		if err != nil {
+			return err
+		}
+		if node.IsMaster {
+			return k3s.JoinK3SServer(ctx, *node, host, opts)
+		}
+		return k3s.InstallK3SAgent(ctx, *node, host, opts)
+	}
+
+	for {
+		err := install()
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, k3s.ErrorSSHNotReady) {
+			return cfg, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return cfg, ctx.Err()
+		case <-time.After(sshRetryInterval):
+		}
+	}
+
+	k3s.RecordVersion(ctx, opts.Connector(), node)
+
+	for di := range node.Dependencies {
+		if node.Dependencies[di].Name == dependencies.K3SDependency.Name {
+			node.Dependencies[di].Status = ertia.DependencyStatusReady
+		}
+	}
+
+	return cfg.UpdateNode(node), nil
+}
+
+// rollbackReplacement removes a replacement that did not make it, leaving the
+// old node in place, and returns the original error.
+func rollbackReplacement(ctx context.Context, p NodeProvider, cfg *ertia.Project, nodeId string, connect k3s.Connector, server ertia.Node, cause error) (*ertia.Project, error) {
+	node := cfg.FindNodeByID(nodeId)
+	if node == nil {
+		return cfg, cause
+	}
+	failed := *node
+
+	log.Ctx(ctx).Error().Err(cause).Str("node", failed.Name).Msg("Replacement failed, rolling back")
+
+	if failed.ProviderID != "" {
+		var err error
+		cfg, err = destroyServer(ctx, p, cfg, failed.ID)
+		if err != nil {
+			log.Ctx(ctx).Error().Err(err).Str("node", failed.Name).Msg("Could not delete failed replacement")
+			return cfg, cause
+		}
+
+		err = k3s.RemoveNode(ctx, connect, server, failed.Name)
+		if err != nil {
+			log.Ctx(ctx).Warn().Err(err).Str("node", failed.Name).Msg("Could not remove failed replacement from cluster")
+		}
+	}
+
+	return cfg.RemoveNode(&failed), cause
+}
@@ -0,0 +1,38 @@
+package providers
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	ertia "github.com/ertia-io/config/pkg/entities"
+)
+
+func TestReplaceNodeNeedsServers(t *testing.T) {
+	cases := []struct {
+		name    string
+		servers int
+	}{
+		{name: "single server", servers: 1},
+		{name: "two servers", servers: 2},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &ertia.Project{}
+			for i := 0; i < tc.servers; i++ {
+				cfg.Nodes = append(cfg.Nodes, ertia.Node{ID: string(rune('a' + i)), IsMaster: true})
+			}
+			cfg.Nodes = append(cfg.Nodes, ertia.Node{ID: "deleted", IsMaster: true, Status: ertia.NodeStatusDeleted})
+
+			// The provider is never reached.
+			_, err := ReplaceNode(context.Background(), nil, cfg, "a")
+			if !errors.Is(err, ErrorNotEnoughServers) {
+				t.Fatalf("got error %v, want %v", err, ErrorNotEnoughServers)
+			}
+			if len(cfg.Nodes) != tc.servers+1 {
+				t.Errorf("project has %d nodes, want none added", len(cfg.Nodes))
+			}
+		})
+	}
+}
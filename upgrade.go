@@ -0,0 +1,118 @@
+package providers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	ertia "github.com/ertia-io/config/pkg/entities"
+	"github.com/ertia-io/providers/dependencies"
+	"github.com/ertia-io/providers/k3s"
+	"github.com/ertia-io/providers/redact"
+	"github.com/rs/zerolog/log"
+)
+
+// UpgradeReadyTimeout bounds how long an upgraded node may take to come back
+// Ready on the new version.
+var UpgradeReadyTimeout = 10 * time.Minute
+
+// UpgradeK3S upgrades k3s in place to version, one node at a time: servers
+// first, then agents. Each node has to report Ready on the new version before
+// the next one is touched. The upgrade stops at the first node that fails.
+func UpgradeK3S(ctx context.Context, p NodeProvider, cfg *ertia.Project, version string) (*ertia.Project, error) {
+	defer redact.Project(cfg)()
+
+	if version == "" {
+		return cfg, errors.New("no k3s version to upgrade to")
+	}
+
+	var servers, agents []string
+	for _, n := range cfg.Nodes {
+		if !n.Fulfils(dependencies.K3SDependency.Name) || k3s.NodeVersion(&n) == version {
+			continue
+		}
+		if n.IsMaster {
+			servers = append(servers, n.ID)
+		} else {
+			agents = append(agents, n.ID)
+		}
+	}
+
+	for _, id := range append(servers, agents...) {
+		var err error
+		cfg, err = upgradeNode(ctx, p, cfg, id, version)
+		if err != nil {
+			return cfg, err
+		}
+	}
+
+	return cfg, nil
+}
+
+// upgradeNode reruns the installer on a node with the new version pinned,
+// keeping its config, and waits for the kubelet to report it.
+func upgradeNode(ctx context.Context, p NodeProvider, cfg *ertia.Project, nodeId, version string) (*ertia.Project, error) {
+	node := cfg.FindNodeByID(nodeId)
+
+	control := controlNode(cfg, *node)
+	if control == nil {
+		return cfg, fmt.Errorf("no ready server node to upgrade %s through", node.Name)
+	}
+	opts := k3sInstallOptions(ctx, p, cfg, node)
+	opts.Version = version
+
+	err := opts.TrustHostKey(ctx, control)
+	if err != nil {
+		return cfg, err
+	}
+	server := *control
+
+	host := joinHost(opts, server)
+
+	// The init server reruns its own install, as do servers from before it
+	// was recorded and the last ready server. Other servers join again
+	// through another server.
+	if node.IsMaster && (k3s.IsInitServer(node) || node.MasterIP == nil || server.ID == node.ID) {
+		host = ""
+	}
+
+	log.Ctx(ctx).Info().Str("node", node.Name).Str("from", k3s.NodeVersion(node)).Str("to", version).Msg("Upgrading k3s")
+
+	readyCtx, cancel := context.WithTimeout(ctx, UpgradeReadyTimeout)
+	defer cancel()
+
+	install := func() error {
+		err := opts.TrustHostKey(readyCtx, node)
+		if err != nil {
+			return err
+		}
+		return k3s.UpgradeK3S(readyCtx, *node, host, opts)
+	}
+
+	for {
+		err := install()
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, k3s.ErrorSSHNotReady) {
+			return cfg, fmt.Errorf("upgrading %s: %w", node.Name, err)
+		}
+
+		select {
+		case <-readyCtx.Done():
+			return cfg, readyCtx.Err()
+		case <-time.After(sshRetryInterval):
+		}
+	}
+
+	err = k3s.WaitForNodeVersion(readyCtx, opts.Connector(), server, node.Name, version, UpgradeReadyTimeout)
+	if err != nil {
+		return cfg, fmt.Errorf("upgrading %s: %w", node.Name, err)
+	}
+
+	k3s.SetNodeVersion(node, version)
+	node.Updated = time.Now()
+
+	return cfg.UpdateNode(node), nil
+}
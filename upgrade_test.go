@@ -0,0 +1,142 @@
+package providers
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	ertia "github.com/ertia-io/config/pkg/entities"
+	"github.com/ertia-io/providers/dependencies"
+	"github.com/ertia-io/providers/k3s"
+	"github.com/ertia-io/providers/k3s/k3stest"
+)
+
+// fakeProvider installs k3s through a fake executor and provisions nothing.
+type fakeProvider struct {
+	NodeProvider
+	exec *k3stest.FakeExecutor
+}
+
+func (p fakeProvider) K3SInstallOptions(ctx context.Context, cfg *ertia.Project, node *ertia.Node) k3s.InstallOptions {
+	return k3s.InstallOptions{Connect: p.exec.Connect}
+}
+
+func readyServer(id, ip string) ertia.Node {
+	return ertia.Node{
+		ID: id, Name: "server-" + id, IsMaster: true, IPV4: net.ParseIP(ip),
+		Dependencies: []ertia.Dependency{{Name: dependencies.K3SDependency.Name, Status: ertia.DependencyStatusReady}},
+	}
+}
+
+func TestUpgradeNode(t *testing.T) {
+	initServer := readyServer("a", "10.0.0.1")
+	k3s.SetInitServer(&initServer)
+
+	// Pointed at itself by a replace before the rewrite was fixed.
+	pointsAtItself := initServer
+	pointsAtItself.MasterIP = initServer.IPV4
+
+	legacy := readyServer("a", "10.0.0.1")
+
+	joined := readyServer("b", "10.0.0.2")
+	joined.MasterIP = initServer.IPV4
+
+	notReady := joined
+	notReady.Dependencies = nil
+
+	agent := ertia.Node{ID: "c", Name: "agent-c", MasterIP: initServer.IPV4, NodeToken: "K10token"}
+
+	cases := []struct {
+		name    string
+		nodes   []ertia.Node
+		upgrade string
+
+		// joins is the server the node joins through, none when empty.
+		joins string
+	}{
+		{name: "init server", nodes: []ertia.Node{initServer, joined}, upgrade: "a"},
+		{name: "init server pointing at itself", nodes: []ertia.Node{pointsAtItself, joined}, upgrade: "a"},
+		{name: "first server without init tag", nodes: []ertia.Node{legacy, joined}, upgrade: "a"},
+		{name: "joined server", nodes: []ertia.Node{initServer, joined}, upgrade: "b", joins: "10.0.0.1"},
+		{name: "last ready server", nodes: []ertia.Node{pointsAtItself, notReady}, upgrade: "a"},
+		{name: "agent", nodes: []ertia.Node{initServer, agent}, upgrade: "c", joins: "10.0.0.1"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			f := k3stest.NewFakeExecutor()
+			f.Outputs["k3s kubectl"] = []byte("True v1.26.1+k3s1")
+
+			cfg := &ertia.Project{Nodes: append([]ertia.Node{}, tc.nodes...)}
+
+			cfg, err := upgradeNode(context.Background(), fakeProvider{exec: f}, cfg, tc.upgrade, "v1.26.1+k3s1")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			ran := strings.Join(f.Commands, "\n")
+			joins := strings.Contains(ran, "K3S_URL=")
+			if tc.joins == "" && joins || tc.joins != "" && !strings.Contains(ran, "K3S_URL=https://"+tc.joins+":6443") {
+				t.Errorf("ran %q, want to join through %q", ran, tc.joins)
+			}
+			if got := k3s.NodeVersion(cfg.FindNodeByID(tc.upgrade)); got != "v1.26.1+k3s1" {
+				t.Errorf("recorded version %q", got)
+			}
+		})
+	}
+}
+
+func TestRejoinNodes(t *testing.T) {
+	old := readyServer("a", "10.0.0.1")
+
+	cases := []struct {
+		name  string
+		nodes []ertia.Node
+
+		// want maps node IDs to the MasterIP they join through after old
+		// is removed, "" for none.
+		want map[string]string
+	}{
+		{
+			name: "servers join each other",
+			nodes: []ertia.Node{
+				withMasterIP(readyServer("b", "10.0.0.2"), old.IPV4),
+				withMasterIP(readyServer("c", "10.0.0.3"), old.IPV4),
+				withMasterIP(ertia.Node{ID: "d"}, old.IPV4),
+			},
+			want: map[string]string{"b": "10.0.0.3", "c": "10.0.0.2", "d": "10.0.0.2"},
+		},
+		{
+			name:  "last server joins nothing",
+			nodes: []ertia.Node{withMasterIP(readyServer("b", "10.0.0.2"), old.IPV4)},
+			want:  map[string]string{"b": ""},
+		},
+		{
+			name: "other servers are kept",
+			nodes: []ertia.Node{
+				readyServer("b", "10.0.0.2"),
+				withMasterIP(readyServer("c", "10.0.0.3"), net.ParseIP("10.0.0.2")),
+			},
+			want: map[string]string{"b": "", "c": "10.0.0.2"},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := rejoinNodes(&ertia.Project{Nodes: tc.nodes}, old)
+
+			for id, want := range tc.want {
+				got := cfg.FindNodeByID(id).MasterIP
+				if want == "" && got != nil || want != "" && !got.Equal(net.ParseIP(want)) {
+					t.Errorf("%s joins through %v, want %q", id, got, want)
+				}
+			}
+		})
+	}
+}
+
+func withMasterIP(node ertia.Node, ip net.IP) ertia.Node {
+	node.MasterIP = ip
+	return node
+}